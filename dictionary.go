@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+
+	"github.com/EVE-Tools/market-streamer/lib/compression"
+	"github.com/sirupsen/logrus"
+)
+
+// Train a zstd dictionary from captured payloads, usage: market-streamer train-dictionary [-size bytes] [-o file] payloads...
+func trainDictionary(args []string) {
+	flags := flag.NewFlagSet("train-dictionary", flag.ExitOnError)
+	size := flags.Int("size", 112640, "maximum size of the dictionary in bytes")
+	output := flags.String("o", "dictionary.zstd", "file the dictionary is written to")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		logrus.Fatal("No payload files given!")
+	}
+
+	// Payloads are decompressed no matter which codec they were captured with
+	var samples [][]byte
+	for _, path := range flags.Args() {
+		payload, err := ioutil.ReadFile(path)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not read payload!")
+		}
+
+		sample, err := compression.Decompress(payload)
+		if err != nil {
+			logrus.WithError(err).WithField("path", path).Fatal("Could not decompress payload!")
+		}
+
+		samples = append(samples, sample)
+	}
+
+	dictionary, err := compression.TrainDictionary(samples, *size)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not train dictionary!")
+	}
+
+	err = ioutil.WriteFile(*output, dictionary, 0644)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not write dictionary!")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"numSamples": len(samples),
+		"bytes":      len(dictionary),
+		"path":       *output,
+	}).Info("Dictionary written.")
+
+	os.Exit(0)
+}
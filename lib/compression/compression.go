@@ -0,0 +1,182 @@
+package compression
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Names of supported codecs
+const (
+	None = "none"
+	Zlib = "zlib"
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// Codec compresses payloads. Its output can be identified by its magic bytes (see Detect).
+type Codec interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+}
+
+// NewCodec returns the codec with the given name, dictionary is only used by zstd and may be nil
+func NewCodec(name string, dictionary []byte) (Codec, error) {
+	switch name {
+	case None:
+		return noneCodec{}, nil
+	case Zlib:
+		return zlibCodec{}, nil
+	case Gzip:
+		return gzipCodec{}, nil
+	case Zstd:
+		options := []zstd.EOption{zstd.WithEncoderLevel(zstd.SpeedBetterCompression)}
+		if dictionary != nil {
+			options = append(options, zstd.WithEncoderDict(dictionary))
+		}
+
+		encoder, err := zstd.NewWriter(nil, options...)
+		if err != nil {
+			return nil, err
+		}
+
+		return zstdCodec{encoder: encoder}, nil
+	}
+
+	return nil, fmt.Errorf("unknown codec: %s", name)
+}
+
+// Detect returns the name of the codec which produced data by looking at its magic bytes. Uncompressed
+// data is only told apart reliably if it is JSON, as e.g. protobuf may start like a zlib header.
+func Detect(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return Zstd
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		return Gzip
+	case len(data) >= 2 && data[0]&0x0f == 8 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0:
+		return Zlib
+	}
+
+	return None
+}
+
+// Decompress detects the codec used for data and decompresses it, dictionaries are only used by zstd
+func Decompress(data []byte, dictionaries ...[]byte) ([]byte, error) {
+	switch Detect(data) {
+	case Zstd:
+		decoder, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dictionaries...))
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+
+		return decoder.DecodeAll(data, nil)
+	case Gzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+
+		return ioutil.ReadAll(reader)
+	case Zlib:
+		reader, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+
+		return ioutil.ReadAll(reader)
+	}
+
+	return data, nil
+}
+
+// TrainDictionary builds a zstd dictionary of at most maxSize bytes from uncompressed samples
+func TrainDictionary(samples [][]byte, maxSize int) ([]byte, error) {
+	if len(samples) == 0 {
+		return nil, errors.New("no samples to train dictionary on")
+	}
+
+	return dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: maxSize,
+		HashBytes:   6,
+		ZstdLevel:   zstd.SpeedBetterCompression,
+	})
+}
+
+type noneCodec struct{}
+
+func (codec noneCodec) Name() string {
+	return None
+}
+
+func (codec noneCodec) Compress(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+type zlibCodec struct{}
+
+func (codec zlibCodec) Name() string {
+	return Zlib
+}
+
+func (codec zlibCodec) Compress(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := zlib.NewWriter(&buffer)
+
+	_, err := writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+type gzipCodec struct{}
+
+func (codec gzipCodec) Name() string {
+	return Gzip
+}
+
+func (codec gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+
+	_, err := writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// The encoder is safe for concurrent use with EncodeAll
+type zstdCodec struct {
+	encoder *zstd.Encoder
+}
+
+func (codec zstdCodec) Name() string {
+	return Zstd
+}
+
+func (codec zstdCodec) Compress(data []byte) ([]byte, error) {
+	return codec.encoder.EncodeAll(data, nil), nil
+}
@@ -0,0 +1,71 @@
+package compression
+
+import (
+	"bytes"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Start of a protobuf snapshot of the region, field 1 being the regionID
+func protobufPayload(regionID int64) []byte {
+	payload := protowire.AppendTag(nil, 1, protowire.VarintType)
+	payload = protowire.AppendVarint(payload, uint64(regionID))
+	payload = protowire.AppendTag(payload, 3, protowire.BytesType)
+
+	return protowire.AppendString(payload, "Element43/market-streamer")
+}
+
+func TestRoundTrip(t *testing.T) {
+	payloads := map[string][]byte{
+		"uudif":             []byte(`{"resultType":"orders","version":"0.1","rowsets":[]}`),
+		"protobuf 10000002": protobufPayload(10000002),
+		"protobuf 10000025": protobufPayload(10000025),
+		"protobuf 10000056": protobufPayload(10000056),
+	}
+
+	for _, name := range []string{Zlib, Gzip, Zstd} {
+		codec, err := NewCodec(name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for payloadName, payload := range payloads {
+			compressed, err := codec.Compress(payload)
+			if err != nil {
+				t.Fatalf("%s %s: %v", name, payloadName, err)
+			}
+
+			if detected := Detect(compressed); detected != name {
+				t.Errorf("%s %s: detected %s", name, payloadName, detected)
+			}
+
+			decompressed, err := Decompress(compressed)
+			if err != nil {
+				t.Fatalf("%s %s: %v", name, payloadName, err)
+			}
+
+			if !bytes.Equal(decompressed, payload) {
+				t.Errorf("%s %s: payload changed", name, payloadName)
+			}
+		}
+	}
+}
+
+func TestDetectUncompressed(t *testing.T) {
+	if detected := Detect([]byte(`{"resultType":"orders"}`)); detected != None {
+		t.Errorf("detected %s for uncompressed JSON", detected)
+	}
+
+	// The reason the protobuf format requires compression
+	if detected := Detect(protobufPayload(10000025)); detected != Zlib {
+		t.Errorf("detected %s for uncompressed protobuf of region 10000025, expected it to look like zlib", detected)
+	}
+}
+
+func TestUnknownCodec(t *testing.T) {
+	_, err := NewCodec("lzma", nil)
+	if err == nil {
+		t.Error("expected error for unknown codec")
+	}
+}
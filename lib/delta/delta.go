@@ -0,0 +1,138 @@
+package delta
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/EVE-Tools/emdr-to-nsq/lib/emds"
+)
+
+// Delta modes
+const (
+	// ModeOff only publishes full snapshots
+	ModeOff = "off"
+
+	// ModeAlongside publishes deltas in addition to full snapshots
+	ModeAlongside = "alongside"
+
+	// ModeOnly publishes deltas and full snapshots as periodic keyframes
+	ModeOnly = "only"
+)
+
+// Delta holds the changes of a region's orders between two snapshots
+type Delta struct {
+	RegionID         int64        `json:"regionID"`
+	LastModified     time.Time    `json:"lastModified"`
+	BaseLastModified time.Time    `json:"baseLastModified"`
+	Added            []emds.Order `json:"added"`
+	Changed          []emds.Order `json:"changed"`
+	Removed          []emds.Order `json:"removed"`
+}
+
+var mode = ModeOff
+var keyframeInterval int
+
+// regionID -> last snapshot
+var snapshots = struct {
+	sync.Mutex
+	store map[int64]snapshot
+}{store: make(map[int64]snapshot)}
+
+type snapshot struct {
+	lastModified      time.Time
+	orders            map[int64]emds.Order
+	updatesToKeyframe int
+}
+
+// Initialize sets the delta mode and after how many updates a keyframe is sent in ModeOnly
+func Initialize(deltaMode string, interval int) error {
+	if deltaMode != ModeOff && deltaMode != ModeAlongside && deltaMode != ModeOnly {
+		return fmt.Errorf("unknown delta mode: %s", deltaMode)
+	}
+
+	if interval < 1 {
+		return fmt.Errorf("invalid keyframe interval: %d", interval)
+	}
+
+	mode = deltaMode
+	keyframeInterval = interval
+
+	return nil
+}
+
+// Update returns the changes of the region's current orders since the last update (nil if there was none).
+// If publishSnapshot is set, the full snapshot should be published as well. The orders only become the base
+// of the next update once commit is called, which should happen after the messages were built.
+func Update(regionID int64, lastModified time.Time, rowsets []emds.Rowset) (regionDelta *Delta, publishSnapshot bool, commit func()) {
+	if mode == ModeOff {
+		return nil, true, func() {}
+	}
+
+	orders := make(map[int64]emds.Order)
+	for _, rowset := range rowsets {
+		for _, order := range rowset.Rows {
+			orders[order.OrderID] = order
+		}
+	}
+
+	snapshots.Lock()
+	previous, ok := snapshots.store[regionID]
+	current := snapshot{
+		lastModified:      lastModified,
+		orders:            orders,
+		updatesToKeyframe: previous.updatesToKeyframe - 1,
+	}
+
+	isKeyframe := !ok || current.updatesToKeyframe <= 0
+	if isKeyframe {
+		current.updatesToKeyframe = keyframeInterval
+	}
+
+	snapshots.Unlock()
+
+	if ok {
+		added, changed, removed := Compare(previous.orders, orders)
+		regionDelta = &Delta{
+			RegionID:         regionID,
+			LastModified:     lastModified,
+			BaseLastModified: previous.lastModified,
+			Added:            added,
+			Changed:          changed,
+			Removed:          removed,
+		}
+	}
+
+	commit = func() {
+		snapshots.Lock()
+		snapshots.store[regionID] = current
+		snapshots.Unlock()
+	}
+
+	return regionDelta, mode == ModeAlongside || isKeyframe, commit
+}
+
+// Compare returns orders which were added, changed or removed between two sets of orders
+func Compare(previous map[int64]emds.Order, current map[int64]emds.Order) (added []emds.Order, changed []emds.Order, removed []emds.Order) {
+	for orderID, order := range current {
+		previousOrder, ok := previous[orderID]
+		if !ok {
+			added = append(added, order)
+			continue
+		}
+
+		// Every order of a snapshot is re-generated, so ignore that
+		previousOrder.GeneratedAt = order.GeneratedAt
+		if previousOrder != order {
+			changed = append(changed, order)
+		}
+	}
+
+	for orderID, order := range previous {
+		if _, ok := current[orderID]; !ok {
+			removed = append(removed, order)
+		}
+	}
+
+	return added, changed, removed
+}
@@ -0,0 +1,279 @@
+package delta
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/EVE-Tools/emdr-to-nsq/lib/emds"
+)
+
+func order(orderID int64, price float64, volRemaining int64, generatedAt string) emds.Order {
+	return emds.Order{
+		OrderID:      orderID,
+		RegionID:     10000002,
+		TypeID:       34,
+		GeneratedAt:  generatedAt,
+		Price:        price,
+		VolRemaining: volRemaining,
+		StationID:    60003760,
+	}
+}
+
+func orderMap(orders ...emds.Order) map[int64]emds.Order {
+	result := make(map[int64]emds.Order)
+	for _, order := range orders {
+		result[order.OrderID] = order
+	}
+
+	return result
+}
+
+func orderIDs(orders []emds.Order) []int64 {
+	ids := []int64{}
+	for _, order := range orders {
+		ids = append(ids, order.OrderID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids
+}
+
+func equalIDs(a []int64, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestCompare(t *testing.T) {
+	const before = "2017-06-01T12:30:00+00:00"
+	const after = "2017-06-01T12:35:00+00:00"
+
+	tests := []struct {
+		name     string
+		previous map[int64]emds.Order
+		current  map[int64]emds.Order
+		added    []int64
+		changed  []int64
+		removed  []int64
+	}{
+		{
+			name:     "unchanged",
+			previous: orderMap(order(1, 5, 10, before)),
+			current:  orderMap(order(1, 5, 10, before)),
+		},
+		{
+			name:     "only regenerated",
+			previous: orderMap(order(1, 5, 10, before), order(2, 6, 20, before)),
+			current:  orderMap(order(1, 5, 10, after), order(2, 6, 20, after)),
+		},
+		{
+			name:     "added",
+			previous: orderMap(order(1, 5, 10, before)),
+			current:  orderMap(order(1, 5, 10, after), order(2, 6, 20, after)),
+			added:    []int64{2},
+		},
+		{
+			name:     "price changed",
+			previous: orderMap(order(1, 5, 10, before)),
+			current:  orderMap(order(1, 4.5, 10, after)),
+			changed:  []int64{1},
+		},
+		{
+			name:     "volume changed",
+			previous: orderMap(order(1, 5, 10, before)),
+			current:  orderMap(order(1, 5, 3, after)),
+			changed:  []int64{1},
+		},
+		{
+			name:     "removed",
+			previous: orderMap(order(1, 5, 10, before), order(2, 6, 20, before)),
+			current:  orderMap(order(2, 6, 20, after)),
+			removed:  []int64{1},
+		},
+		{
+			name:     "first snapshot",
+			previous: nil,
+			current:  orderMap(order(1, 5, 10, after), order(2, 6, 20, after)),
+			added:    []int64{1, 2},
+		},
+		{
+			name:     "emptied",
+			previous: orderMap(order(1, 5, 10, before), order(2, 6, 20, before)),
+			current:  nil,
+			removed:  []int64{1, 2},
+		},
+		{
+			name:     "mixed",
+			previous: orderMap(order(1, 5, 10, before), order(2, 6, 20, before), order(3, 7, 30, before)),
+			current:  orderMap(order(2, 6, 20, after), order(3, 7, 29, after), order(4, 8, 40, after)),
+			added:    []int64{4},
+			changed:  []int64{3},
+			removed:  []int64{1},
+		},
+	}
+
+	for _, test := range tests {
+		added, changed, removed := Compare(test.previous, test.current)
+
+		if !equalIDs(orderIDs(added), test.added) {
+			t.Errorf("%s: got added %v, want %v", test.name, orderIDs(added), test.added)
+		}
+
+		if !equalIDs(orderIDs(changed), test.changed) {
+			t.Errorf("%s: got changed %v, want %v", test.name, orderIDs(changed), test.changed)
+		}
+
+		if !equalIDs(orderIDs(removed), test.removed) {
+			t.Errorf("%s: got removed %v, want %v", test.name, orderIDs(removed), test.removed)
+		}
+	}
+}
+
+func TestChangedOrderHasCurrentValues(t *testing.T) {
+	_, changed, _ := Compare(
+		orderMap(order(1, 5, 10, "2017-06-01T12:30:00+00:00")),
+		orderMap(order(1, 4.5, 10, "2017-06-01T12:35:00+00:00")),
+	)
+
+	if len(changed) != 1 || changed[0].Price != 4.5 || changed[0].GeneratedAt != "2017-06-01T12:35:00+00:00" {
+		t.Errorf("got changed %v, want current order", changed)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	tests := []struct {
+		mode     string
+		interval int
+		// Whether the snapshot is published on each consecutive update
+		snapshots []bool
+	}{
+		{ModeOff, 1, []bool{true, true, true, true}},
+		{ModeAlongside, 3, []bool{true, true, true, true}},
+		{ModeOnly, 1, []bool{true, true, true, true}},
+		{ModeOnly, 3, []bool{true, false, false, true, false, false, true}},
+	}
+
+	for _, test := range tests {
+		err := Initialize(test.mode, test.interval)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshots.store = make(map[int64]snapshot)
+
+		lastModified := time.Date(2017, 6, 1, 12, 30, 0, 0, time.UTC)
+		for i, want := range test.snapshots {
+			rowsets := []emds.Rowset{{RegionID: 10000002, TypeID: 34, Rows: []emds.Order{order(1, float64(5+i), 10, "")}}}
+			regionDelta, publishSnapshot, commit := Update(10000002, lastModified.Add(time.Duration(i)*5*time.Minute), rowsets)
+			commit()
+
+			if publishSnapshot != want {
+				t.Errorf("%s/%d update %d: got publishSnapshot %t, want %t", test.mode, test.interval, i, publishSnapshot, want)
+			}
+
+			if test.mode == ModeOff || i == 0 {
+				if regionDelta != nil {
+					t.Errorf("%s/%d update %d: got delta without previous snapshot", test.mode, test.interval, i)
+				}
+				continue
+			}
+
+			if regionDelta == nil {
+				t.Fatalf("%s/%d update %d: got no delta", test.mode, test.interval, i)
+			}
+
+			if !regionDelta.BaseLastModified.Equal(lastModified.Add(time.Duration(i-1) * 5 * time.Minute)) {
+				t.Errorf("%s/%d update %d: got base %s", test.mode, test.interval, i, regionDelta.BaseLastModified)
+			}
+
+			if len(regionDelta.Changed) != 1 {
+				t.Errorf("%s/%d update %d: got %d changed orders, want 1", test.mode, test.interval, i, len(regionDelta.Changed))
+			}
+		}
+	}
+}
+
+func TestUpdateKeyframesPerRegion(t *testing.T) {
+	err := Initialize(ModeOnly, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots.store = make(map[int64]snapshot)
+
+	lastModified := time.Date(2017, 6, 1, 12, 30, 0, 0, time.UTC)
+
+	// A new region gets a keyframe regardless of the others' counters
+	first := updateAndCommit(10000002, lastModified)
+	second := updateAndCommit(10000002, lastModified)
+	other := updateAndCommit(10000043, lastModified)
+	third := updateAndCommit(10000002, lastModified)
+
+	if !first || second || !other || !third {
+		t.Errorf("got keyframes %t %t %t %t, want true false true true", first, second, other, third)
+	}
+}
+
+func updateAndCommit(regionID int64, lastModified time.Time) bool {
+	_, publishSnapshot, commit := Update(regionID, lastModified, nil)
+	commit()
+
+	return publishSnapshot
+}
+
+func TestUpdateWithoutCommit(t *testing.T) {
+	err := Initialize(ModeOnly, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots.store = make(map[int64]snapshot)
+
+	lastModified := time.Date(2017, 6, 1, 12, 30, 0, 0, time.UTC)
+	rowsets := func(price float64) []emds.Rowset {
+		return []emds.Rowset{{RegionID: 10000002, TypeID: 34, Rows: []emds.Order{order(1, price, 10, "")}}}
+	}
+
+	_, _, commit := Update(10000002, lastModified, rowsets(5))
+	commit()
+
+	// Building the messages failed, so the update is not committed
+	Update(10000002, lastModified.Add(5*time.Minute), rowsets(6))
+
+	// The next delta is still based on the last committed snapshot
+	regionDelta, publishSnapshot, _ := Update(10000002, lastModified.Add(10*time.Minute), rowsets(7))
+	if regionDelta == nil || !regionDelta.BaseLastModified.Equal(lastModified) {
+		t.Fatalf("got delta %+v, want base %s", regionDelta, lastModified)
+	}
+
+	if publishSnapshot {
+		t.Error("uncommitted update counted towards the keyframe interval")
+	}
+}
+
+func TestInitialize(t *testing.T) {
+	tests := []struct {
+		mode     string
+		interval int
+		valid    bool
+	}{
+		{ModeOff, 12, true},
+		{ModeAlongside, 12, true},
+		{ModeOnly, 1, true},
+		{ModeOnly, 0, false},
+		{"sometimes", 12, false},
+	}
+
+	for _, test := range tests {
+		err := Initialize(test.mode, test.interval)
+		if (err == nil) != test.valid {
+			t.Errorf("%s/%d: got error %v", test.mode, test.interval, err)
+		}
+	}
+}
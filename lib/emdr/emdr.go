@@ -1,35 +1,192 @@
 package emdr
 
 import (
-	"github.com/pebbe/zmq4"
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/EVE-Tools/emdr-to-nsq/lib/emds"
+	"github.com/EVE-Tools/market-streamer/lib/leader"
+	"github.com/sirupsen/logrus"
 )
 
-var messageChannel chan []byte
-var upstreamSocket *zmq4.Socket
+var messageChannel chan *Message
+var sinkQueues []sinkQueue
+
+type sinkQueue struct {
+	name     string
+	messages chan *Message
+}
+
+// sink name -> number of messages dropped because the sink's queue was full
+var droppedMessages = expvar.NewMap("droppedMessages")
 
-// Initialize sets up the EMDR emulation socket
-func Initialize(bindEndpoint string) chan<- []byte {
-	messageChannel = make(chan []byte, 100)
+// Closed on shutdown, sink loops are done once all queued messages were published
+var stopSending = make(chan struct{})
+var sinkLoops sync.WaitGroup
+
+// Number of messages dropped because they were scraped in another leader's term
+var fencedMessages = expvar.NewInt("fencedMessages")
+
+// MessageType distinguishes full snapshots from other messages
+type MessageType int
+
+// Message types
+const (
+	TypeSnapshot MessageType = iota
+	TypeDelta
+	TypeOrderEvents
+)
 
-	s, err := zmq4.NewSocket(zmq4.PUB)
-	if err != nil {
-		panic(err)
+// Message is a region's market snapshot (or its changes) along with its metadata
+type Message struct {
+	Type         MessageType
+	RegionID     int64
+	LastModified time.Time
+	NextRun      time.Time
+	NumOrders    int
+	Inconsistent bool
+	// Structures which failed to load and are missing in the snapshot
+	FailedStructures []int64
+	Rowsets          []emds.Rowset
+	Format           string
+	Codec            string
+	Payload          []byte
+	// Leader term the message was scraped in, messages of past terms are not published
+	Term uint64
+}
+
+// String returns the type's name as used in headers
+func (messageType MessageType) String() string {
+	switch messageType {
+	case TypeSnapshot:
+		return "snapshot"
+	case TypeDelta:
+		return "delta"
+	case TypeOrderEvents:
+		return "orderEvents"
 	}
 
-	upstreamSocket = s
+	return "unknown"
+}
+
+// Sink is a destination messages are published to
+type Sink interface {
+	Name() string
+	Publish(message *Message) error
+	Close() error
+}
+
+// Initialize sets up the EMDR emulation and fans out messages to all sinks
+func Initialize(sinks []Sink) chan<- *Message {
+	messageChannel = make(chan *Message, 100)
+
+	// Every sink gets its own queue so a slow sink does not stall the others, messages for a sink
+	// whose queue is full are dropped
+	for _, sink := range sinks {
+		queue := sinkQueue{
+			name:     sink.Name(),
+			messages: make(chan *Message, 100),
+		}
+		sinkQueues = append(sinkQueues, queue)
 
-	upstreamSocket.Bind(bindEndpoint)
+		sinkLoops.Add(1)
+		go runSinkLoop(sink, queue.messages)
+	}
 
 	go runSendLoop()
 
 	return messageChannel
 }
 
-func runSendLoop() {
-	defer upstreamSocket.Close()
+// Shutdown publishes all messages which are already queued and closes the sinks, waiting until ctx is
+// done at most. Messages sent afterwards are never published.
+func Shutdown(ctx context.Context) error {
+	close(stopSending)
+
+	done := make(chan struct{})
+	go func() {
+		sinkLoops.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
+func runSendLoop() {
 	for {
-		msg := <-messageChannel
-		upstreamSocket.SendBytes(msg, 0)
+		select {
+		case msg := <-messageChannel:
+			fanOut(msg)
+		case <-stopSending:
+			// Flush buffered messages, then let the sink loops finish their queues
+			for {
+				select {
+				case msg := <-messageChannel:
+					// Shutdown is bounded by its deadline, so wait for slow sinks instead of dropping
+					for _, queue := range sinkQueues {
+						queue.messages <- msg
+					}
+				default:
+					for _, queue := range sinkQueues {
+						close(queue.messages)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// Queue message for every sink without blocking, so a stuck sink does not stall the others or the scrapers
+func fanOut(msg *Message) {
+	for _, queue := range sinkQueues {
+		select {
+		case queue.messages <- msg:
+		default:
+			droppedMessages.Add(queue.name, 1)
+			logrus.WithFields(logrus.Fields{
+				"sink":     queue.name,
+				"regionID": msg.RegionID,
+				"type":     msg.Type.String(),
+			}).Warn("Sink's queue is full, dropping message.")
+		}
+	}
+}
+
+func runSinkLoop(sink Sink, queue <-chan *Message) {
+	defer sinkLoops.Done()
+	defer func() {
+		err := sink.Close()
+		if err != nil {
+			logrus.WithError(err).WithField("sink", sink.Name()).Warn("Failed to close sink.")
+		}
+	}()
+
+	for msg := range queue {
+		// Fencing: a deposed leader must not publish, even if the message was queued before
+		if !leader.IsCurrent(msg.Term) {
+			fencedMessages.Add(1)
+			logrus.WithFields(logrus.Fields{
+				"sink":     sink.Name(),
+				"regionID": msg.RegionID,
+				"term":     msg.Term,
+			}).Debug("Dropping message of past leader term.")
+			continue
+		}
+
+		err := sink.Publish(msg)
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"sink":     sink.Name(),
+				"regionID": msg.RegionID,
+			}).Error("Failed to publish market.")
+		}
 	}
 }
@@ -0,0 +1,118 @@
+package emdr
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// How long closing the connection waits for buffered messages to be sent
+const natsFlushTimeout = 3 * time.Second
+
+// NATSSink publishes messages on per-region NATS subjects, optionally persisted by JetStream
+type NATSSink struct {
+	conn          *nats.Conn
+	jetStream     nats.JetStreamContext
+	subjectPrefix string
+}
+
+// NewNATSSink connects to NATS. If streamName is not empty, messages are published to
+// that JetStream stream, which is created if it does not exist.
+func NewNATSSink(url string, subjectPrefix string, streamName string) (*NATSSink, error) {
+	conn, err := nats.Connect(url, nats.Name("market-streamer"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+
+	sink := NATSSink{
+		conn:          conn,
+		subjectPrefix: subjectPrefix,
+	}
+
+	if streamName != "" {
+		sink.jetStream, err = conn.JetStream()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		err = ensureStream(sink.jetStream, streamName, subjectPrefix)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return &sink, nil
+}
+
+// Create the stream if it does not exist yet
+func ensureStream(jetStream nats.JetStreamContext, streamName string, subjectPrefix string) error {
+	_, err := jetStream.StreamInfo(streamName)
+	if err == nil {
+		return nil
+	}
+
+	if err != nats.ErrStreamNotFound {
+		return err
+	}
+
+	// Keep dedup window longer than a market's cache timer
+	_, err = jetStream.AddStream(&nats.StreamConfig{
+		Name:       streamName,
+		Subjects:   []string{subjectPrefix + ".>"},
+		Duplicates: 15 * time.Minute,
+	})
+
+	return err
+}
+
+// Name returns the sink's name
+func (sink *NATSSink) Name() string {
+	return "nats"
+}
+
+// Publish sends the message's payload to the region's subject, suffixed by the type for non-snapshots
+func (sink *NATSSink) Publish(message *Message) error {
+	if int64(len(message.Payload)) > sink.conn.MaxPayload() {
+		return fmt.Errorf("payload of %d bytes exceeds NATS max_payload of %d bytes", len(message.Payload), sink.conn.MaxPayload())
+	}
+
+	subject := fmt.Sprintf("%s.%d", sink.subjectPrefix, message.RegionID)
+	if message.Type != TypeSnapshot {
+		subject = fmt.Sprintf("%s.%s", subject, message.Type)
+	}
+
+	msg := nats.NewMsg(subject)
+	msg.Data = message.Payload
+	msg.Header.Set("Message-Type", message.Type.String())
+	msg.Header.Set("Region-Id", strconv.FormatInt(message.RegionID, 10))
+	msg.Header.Set("Last-Modified", message.LastModified.UTC().Format(time.RFC1123))
+	msg.Header.Set("Num-Orders", strconv.Itoa(message.NumOrders))
+	msg.Header.Set("Inconsistent", strconv.FormatBool(message.Inconsistent))
+	for _, structureID := range message.FailedStructures {
+		msg.Header.Add("Failed-Structure", strconv.FormatInt(structureID, 10))
+	}
+	msg.Header.Set("Content-Type", message.Format)
+	msg.Header.Set("Content-Encoding", message.Codec)
+
+	if sink.jetStream == nil {
+		return sink.conn.PublishMsg(msg)
+	}
+
+	// The same region and ESI generation always yields the same ID, so JetStream drops duplicates
+	dedupID := fmt.Sprintf("%s-%d-%d", message.Type, message.RegionID, message.LastModified.Unix())
+	_, err := sink.jetStream.PublishMsg(msg, nats.MsgId(dedupID))
+
+	return err
+}
+
+// Close sends buffered messages and closes the connection, blocking for up to natsFlushTimeout
+func (sink *NATSSink) Close() error {
+	err := sink.conn.FlushTimeout(natsFlushTimeout)
+	sink.conn.Close()
+
+	return err
+}
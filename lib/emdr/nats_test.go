@@ -0,0 +1,170 @@
+package emdr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+func runNATSServer(t *testing.T, jetStream bool) *server.Server {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = jetStream
+	opts.StoreDir = t.TempDir()
+
+	natsServer := natsserver.RunServer(&opts)
+	t.Cleanup(natsServer.Shutdown)
+
+	return natsServer
+}
+
+func testMessage(messageType MessageType, lastModified time.Time) *Message {
+	return &Message{
+		Type:             messageType,
+		RegionID:         10000002,
+		LastModified:     lastModified,
+		NumOrders:        42,
+		Inconsistent:     true,
+		FailedStructures: []int64{1022734985679, 1028858195912},
+		Format:           "protobuf",
+		Codec:            "zstd",
+		Payload:          []byte("payload"),
+	}
+}
+
+func TestNATSSinkPublish(t *testing.T) {
+	natsServer := runNATSServer(t, false)
+
+	sink, err := NewNATSSink(natsServer.ClientURL(), "market", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	conn, err := nats.Connect(natsServer.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	subscription, err := conn.SubscribeSync("market.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastModified := time.Date(2017, 6, 1, 12, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		messageType MessageType
+		subject     string
+	}{
+		{TypeSnapshot, "market.10000002"},
+		{TypeDelta, "market.10000002.delta"},
+		{TypeOrderEvents, "market.10000002.orderEvents"},
+	}
+
+	for _, test := range tests {
+		err = sink.Publish(testMessage(test.messageType, lastModified))
+		if err != nil {
+			t.Fatalf("%s: %v", test.messageType, err)
+		}
+
+		msg, err := subscription.NextMsg(5 * time.Second)
+		if err != nil {
+			t.Fatalf("%s: %v", test.messageType, err)
+		}
+
+		if msg.Subject != test.subject {
+			t.Errorf("%s: got subject %q, want %q", test.messageType, msg.Subject, test.subject)
+		}
+
+		if string(msg.Data) != "payload" {
+			t.Errorf("%s: got payload %q", test.messageType, msg.Data)
+		}
+
+		headers := map[string]string{
+			"Message-Type":     test.messageType.String(),
+			"Region-Id":        "10000002",
+			"Last-Modified":    "Thu, 01 Jun 2017 12:30:00 UTC",
+			"Num-Orders":       "42",
+			"Inconsistent":     "true",
+			"Content-Type":     "protobuf",
+			"Content-Encoding": "zstd",
+		}
+		for key, value := range headers {
+			if msg.Header.Get(key) != value {
+				t.Errorf("%s: got header %s %q, want %q", test.messageType, key, msg.Header.Get(key), value)
+			}
+		}
+
+		failedStructures := msg.Header.Values("Failed-Structure")
+		if len(failedStructures) != 2 || failedStructures[0] != "1022734985679" || failedStructures[1] != "1028858195912" {
+			t.Errorf("%s: got Failed-Structure headers %v", test.messageType, failedStructures)
+		}
+	}
+}
+
+func TestNATSSinkDeduplication(t *testing.T) {
+	natsServer := runNATSServer(t, true)
+
+	sink, err := NewNATSSink(natsServer.ClientURL(), "market", "MARKET")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	lastModified := time.Date(2017, 6, 1, 12, 30, 0, 0, time.UTC)
+
+	// Republishing the same generation is dropped, a new generation or another type is not
+	messages := []*Message{
+		testMessage(TypeSnapshot, lastModified),
+		testMessage(TypeSnapshot, lastModified),
+		testMessage(TypeDelta, lastModified),
+		testMessage(TypeSnapshot, lastModified.Add(5*time.Minute)),
+		testMessage(TypeSnapshot, lastModified.Add(5*time.Minute)),
+	}
+
+	for _, message := range messages {
+		err = sink.Publish(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err := sink.jetStream.StreamInfo("MARKET")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.State.Msgs != 3 {
+		t.Errorf("got %d messages in stream, want 3", info.State.Msgs)
+	}
+
+	// Connecting again must reuse the existing stream
+	second, err := NewNATSSink(natsServer.ClientURL(), "market", "MARKET")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	err = second.Publish(testMessage(TypeSnapshot, lastModified))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err = second.jetStream.StreamInfo("MARKET")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.State.Msgs != 3 {
+		t.Errorf("got %d messages in stream after reconnecting, want 3", info.State.Msgs)
+	}
+}
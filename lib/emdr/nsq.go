@@ -0,0 +1,126 @@
+package emdr
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/EVE-Tools/emdr-to-nsq/lib/emds"
+	"github.com/nsqio/go-nsq"
+)
+
+// Stay below nsqd's default --max-body-size of 5 MB when publishing rowsets in batches
+const maxNSQBatchSize = 4 * 1024 * 1024
+
+// NSQSink publishes messages to an NSQ topic, failing over between multiple nsqd instances
+type NSQSink struct {
+	sync.Mutex
+	producers []*nsq.Producer
+	next      int
+	topic     string
+	perType   bool
+}
+
+// NewNSQSink creates producers for all given nsqd addresses. If perType is set, every
+// rowset is published as a separate UUDIF message instead of whole regions.
+func NewNSQSink(nsqdAddresses []string, topic string, perType bool) (*NSQSink, error) {
+	if len(nsqdAddresses) == 0 {
+		return nil, errors.New("no nsqd address configured")
+	}
+
+	sink := NSQSink{
+		topic:   topic,
+		perType: perType,
+	}
+
+	for _, address := range nsqdAddresses {
+		producer, err := nsq.NewProducer(address, nsq.NewConfig())
+		if err != nil {
+			sink.Close()
+			return nil, err
+		}
+
+		sink.producers = append(sink.producers, producer)
+	}
+
+	return &sink, nil
+}
+
+// Name returns the sink's name
+func (sink *NSQSink) Name() string {
+	return "nsq"
+}
+
+// Publish sends the message's payload or its rowsets to the topic, other types than snapshots
+// are sent to a separate topic suffixed by the type (e.g. orders_delta)
+func (sink *NSQSink) Publish(message *Message) error {
+	if message.Type != TypeSnapshot {
+		return sink.publish(sink.topic+"_"+message.Type.String(), [][]byte{message.Payload})
+	}
+
+	if !sink.perType {
+		return sink.publish(sink.topic, [][]byte{message.Payload})
+	}
+
+	var batch [][]byte
+	batchSize := 0
+
+	for _, rowset := range message.Rowsets {
+		rowsetJSON, err := emds.RowsetsToUUDIF([]emds.Rowset{rowset}, "Element43/market-streamer", "0.1")
+		if err != nil {
+			return err
+		}
+
+		if batchSize+len(rowsetJSON) > maxNSQBatchSize && len(batch) > 0 {
+			err = sink.publish(sink.topic, batch)
+			if err != nil {
+				return err
+			}
+
+			batch = nil
+			batchSize = 0
+		}
+
+		batch = append(batch, rowsetJSON)
+		batchSize += len(rowsetJSON)
+	}
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	return sink.publish(sink.topic, batch)
+}
+
+// Publish to the next nsqd, try the others on failure
+func (sink *NSQSink) publish(topic string, bodies [][]byte) error {
+	sink.Lock()
+	start := sink.next
+	sink.next = (sink.next + 1) % len(sink.producers)
+	sink.Unlock()
+
+	var err error
+	for i := range sink.producers {
+		producer := sink.producers[(start+i)%len(sink.producers)]
+
+		if len(bodies) == 1 {
+			err = producer.Publish(topic, bodies[0])
+		} else {
+			err = producer.MultiPublish(topic, bodies)
+		}
+
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// Close stops all producers
+func (sink *NSQSink) Close() error {
+	for _, producer := range sink.producers {
+		producer.Stop()
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package emdr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Comment lines are sent with this period to keep proxies from closing idle connections
+	eventKeepAlivePeriod = 30 * time.Second
+
+	// Number of events queued per client before it is considered too slow
+	eventSendBuffer = 256
+)
+
+// EventSink notifies Server-Sent Events clients about updated regions without sending the payload
+type EventSink struct {
+	sync.RWMutex
+	clients map[*eventClient]struct{}
+}
+
+// Event describes an update of a region's market
+type Event struct {
+	Type             string    `json:"type"`
+	RegionID         int64     `json:"regionID"`
+	LastModified     time.Time `json:"lastModified"`
+	NumOrders        int       `json:"numOrders"`
+	Inconsistent     bool      `json:"inconsistent"`
+	FailedStructures []int64   `json:"failedStructures,omitempty"`
+	PayloadSize      int       `json:"payloadSize"`
+	NextRun          time.Time `json:"nextRun"`
+}
+
+type eventClient struct {
+	events   chan []byte
+	slow     chan struct{}
+	slowOnce sync.Once
+}
+
+// NewEventSink creates a sink which can be mounted as a http.Handler
+func NewEventSink() *EventSink {
+	return &EventSink{
+		clients: make(map[*eventClient]struct{}),
+	}
+}
+
+// Name returns the sink's name
+func (sink *EventSink) Name() string {
+	return "events"
+}
+
+// ServeHTTP streams events to the client until it disconnects
+func (sink *EventSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported.", http.StatusInternalServerError)
+		return
+	}
+
+	client := &eventClient{
+		events: make(chan []byte, eventSendBuffer),
+		slow:   make(chan struct{}),
+	}
+
+	sink.Lock()
+	sink.clients[client] = struct{}{}
+	sink.Unlock()
+
+	defer func() {
+		sink.Lock()
+		delete(sink.clients, client)
+		sink.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventKeepAlivePeriod)
+	defer ticker.Stop()
+
+	for {
+		var err error
+
+		select {
+		case event := <-client.events:
+			_, err = w.Write(event)
+		case <-ticker.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		case <-client.slow:
+			logrus.WithField("remoteAddr", r.RemoteAddr).Info("Disconnecting slow event client.")
+			return
+		case <-r.Context().Done():
+			return
+		}
+
+		if err != nil {
+			return
+		}
+
+		flusher.Flush()
+	}
+}
+
+// Publish sends an event describing the message to all clients
+func (sink *EventSink) Publish(message *Message) error {
+	eventJSON, err := json.Marshal(Event{
+		Type:             message.Type.String(),
+		RegionID:         message.RegionID,
+		LastModified:     message.LastModified,
+		NumOrders:        message.NumOrders,
+		Inconsistent:     message.Inconsistent,
+		FailedStructures: message.FailedStructures,
+		PayloadSize:      len(message.Payload),
+		NextRun:          message.NextRun,
+	})
+	if err != nil {
+		return err
+	}
+
+	event := []byte(fmt.Sprintf("id: %s-%d-%d\nevent: market\ndata: %s\n\n", message.Type, message.RegionID, message.LastModified.Unix(), eventJSON))
+
+	sink.RLock()
+	defer sink.RUnlock()
+
+	for client := range sink.clients {
+		select {
+		case client.events <- event:
+		default:
+			client.slowOnce.Do(func() {
+				close(client.slow)
+			})
+		}
+	}
+
+	return nil
+}
+
+// Close does nothing, clients are disconnected with the HTTP server
+func (sink *EventSink) Close() error {
+	return nil
+}
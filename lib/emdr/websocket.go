@@ -0,0 +1,292 @@
+package emdr
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EVE-Tools/emdr-to-nsq/lib/emds"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Time allowed to write a message to the client
+	webSocketWriteWait = 10 * time.Second
+
+	// Time allowed to read the next pong message from the client
+	webSocketPongWait = 60 * time.Second
+
+	// Send pings to client with this period, must be less than pongWait
+	webSocketPingPeriod = (webSocketPongWait * 9) / 10
+
+	// Maximum size of subscription messages sent by clients
+	webSocketMaxMessageSize = 4096
+
+	// Number of messages queued per client before it is considered too slow
+	webSocketSendBuffer = 4
+)
+
+// WebSocketSink streams messages as UUDIF JSON to WebSocket clients subscribed to their region
+type WebSocketSink struct {
+	sync.RWMutex
+	clients  map[*webSocketClient]struct{}
+	upgrader websocket.Upgrader
+}
+
+// Subscription is sent by clients for choosing regions and (optionally) types
+type Subscription struct {
+	Regions []int64 `json:"regions"`
+	Types   []int64 `json:"types"`
+}
+
+type webSocketClient struct {
+	sync.RWMutex
+	conn    *websocket.Conn
+	send    chan *websocket.PreparedMessage
+	regions map[int64]bool
+	types   map[int64]bool
+	closed  bool
+}
+
+// NewWebSocketSink creates a sink which can be mounted as a http.Handler
+func NewWebSocketSink() *WebSocketSink {
+	return &WebSocketSink{
+		clients: make(map[*webSocketClient]struct{}),
+		upgrader: websocket.Upgrader{
+			EnableCompression: true,
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		},
+	}
+}
+
+// Name returns the sink's name
+func (sink *WebSocketSink) Name() string {
+	return "websocket"
+}
+
+// ServeHTTP upgrades the connection, initial subscriptions can be passed in the query (e.g. ?regions=10000002&types=34,35)
+func (sink *WebSocketSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	regions, err := parseIDs(r.URL.Query().Get("regions"))
+	if err != nil {
+		http.Error(w, "Invalid regions.", http.StatusBadRequest)
+		return
+	}
+
+	types, err := parseIDs(r.URL.Query().Get("types"))
+	if err != nil {
+		http.Error(w, "Invalid types.", http.StatusBadRequest)
+		return
+	}
+
+	conn, err := sink.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logrus.WithError(err).Debug("Failed to upgrade WebSocket connection.")
+		return
+	}
+
+	client := &webSocketClient{
+		conn: conn,
+		send: make(chan *websocket.PreparedMessage, webSocketSendBuffer),
+	}
+	client.subscribe(Subscription{Regions: regions, Types: types})
+
+	sink.Lock()
+	sink.clients[client] = struct{}{}
+	sink.Unlock()
+
+	go sink.runWriteLoop(client)
+	go sink.runReadLoop(client)
+}
+
+// Publish queues snapshots for all subscribed clients, slow clients get disconnected
+func (sink *WebSocketSink) Publish(message *Message) error {
+	if message.Type != TypeSnapshot {
+		return nil
+	}
+
+	sink.RLock()
+	defer sink.RUnlock()
+
+	// Clients without type filter share the same serialized message
+	var fullRegion *websocket.PreparedMessage
+
+	for client := range sink.clients {
+		client.RLock()
+		subscribed := client.regions[message.RegionID]
+		types := client.types
+		client.RUnlock()
+
+		if !subscribed {
+			continue
+		}
+
+		var prepared *websocket.PreparedMessage
+		var err error
+
+		if len(types) == 0 {
+			if fullRegion == nil {
+				fullRegion, err = prepareRowsets(message.Rowsets)
+				if err != nil {
+					return err
+				}
+			}
+
+			prepared = fullRegion
+		} else {
+			var rowsets []emds.Rowset
+			for _, rowset := range message.Rowsets {
+				if types[rowset.TypeID] {
+					rowsets = append(rowsets, rowset)
+				}
+			}
+
+			prepared, err = prepareRowsets(rowsets)
+			if err != nil {
+				return err
+			}
+		}
+
+		select {
+		case client.send <- prepared:
+		default:
+			logrus.WithField("remoteAddr", client.conn.RemoteAddr().String()).Info("Disconnecting slow WebSocket client.")
+			go sink.disconnect(client)
+		}
+	}
+
+	return nil
+}
+
+// Close disconnects all clients
+func (sink *WebSocketSink) Close() error {
+	sink.RLock()
+	var clients []*webSocketClient
+	for client := range sink.clients {
+		clients = append(clients, client)
+	}
+	sink.RUnlock()
+
+	for _, client := range clients {
+		sink.disconnect(client)
+	}
+
+	return nil
+}
+
+// Remove client and close its connection, safe to be called multiple times
+func (sink *WebSocketSink) disconnect(client *webSocketClient) {
+	sink.Lock()
+	delete(sink.clients, client)
+	sink.Unlock()
+
+	client.Lock()
+	defer client.Unlock()
+
+	if !client.closed {
+		client.closed = true
+		close(client.send)
+		client.conn.Close()
+	}
+}
+
+// Write queued messages and keep connection alive with pings
+func (sink *WebSocketSink) runWriteLoop(client *webSocketClient) {
+	ticker := time.NewTicker(webSocketPingPeriod)
+	defer ticker.Stop()
+	defer sink.disconnect(client)
+
+	for {
+		select {
+		case prepared, ok := <-client.send:
+			if !ok {
+				return
+			}
+
+			client.conn.SetWriteDeadline(time.Now().Add(webSocketWriteWait))
+			err := client.conn.WritePreparedMessage(prepared)
+			if err != nil {
+				return
+			}
+		case <-ticker.C:
+			err := client.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(webSocketWriteWait))
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Read subscription changes and pongs
+func (sink *WebSocketSink) runReadLoop(client *webSocketClient) {
+	defer sink.disconnect(client)
+
+	client.conn.SetReadLimit(webSocketMaxMessageSize)
+	client.conn.SetReadDeadline(time.Now().Add(webSocketPongWait))
+	client.conn.SetPongHandler(func(string) error {
+		return client.conn.SetReadDeadline(time.Now().Add(webSocketPongWait))
+	})
+
+	for {
+		var subscription Subscription
+		err := client.conn.ReadJSON(&subscription)
+		if err != nil {
+			return
+		}
+
+		client.subscribe(subscription)
+	}
+}
+
+// Replace the client's subscription
+func (client *webSocketClient) subscribe(subscription Subscription) {
+	regions := make(map[int64]bool)
+	for _, regionID := range subscription.Regions {
+		regions[regionID] = true
+	}
+
+	types := make(map[int64]bool)
+	for _, typeID := range subscription.Types {
+		types[typeID] = true
+	}
+
+	client.Lock()
+	client.regions = regions
+	client.types = types
+	client.Unlock()
+}
+
+// Serialize rowsets to a UUDIF text message, frames are only encoded once for all clients
+func prepareRowsets(rowsets []emds.Rowset) (*websocket.PreparedMessage, error) {
+	rowsetJSON, err := emds.RowsetsToUUDIF(rowsets, "Element43/market-streamer", "0.1")
+	if err != nil {
+		return nil, err
+	}
+
+	return websocket.NewPreparedMessage(websocket.TextMessage, rowsetJSON)
+}
+
+// Parse comma-separated list of IDs
+func parseIDs(list string) ([]int64, error) {
+	var ids []int64
+
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
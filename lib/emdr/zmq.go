@@ -0,0 +1,148 @@
+package emdr
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pebbe/zmq4"
+)
+
+const (
+	// ZMQModeEMDR sends single-frame snapshots compatible with EMDR, other message types are dropped
+	ZMQModeEMDR = "emdr"
+
+	// ZMQModeTopic sends a topic frame (e.g. region:10000002 or region:10000002:delta), a JSON header frame and the payload frame
+	ZMQModeTopic = "topic"
+
+	// ZAP domain used for CURVE authentication
+	zmqCurveDomain = "market-streamer"
+)
+
+// ZMQSink publishes messages on a ZMQ PUB socket in EMDR's format
+type ZMQSink struct {
+	socket *zmq4.Socket
+	mode   string
+	linger time.Duration
+	curve  bool
+}
+
+// ZMQHeader is sent as the second frame in topic mode
+type ZMQHeader struct {
+	Type             string    `json:"type"`
+	RegionID         int64     `json:"regionID"`
+	LastModified     time.Time `json:"lastModified"`
+	NextRun          time.Time `json:"nextRun"`
+	NumOrders        int       `json:"numOrders"`
+	Inconsistent     bool      `json:"inconsistent"`
+	FailedStructures []int64   `json:"failedStructures,omitempty"`
+	Format           string    `json:"format"`
+	Codec            string    `json:"codec"`
+}
+
+// NewZMQSink creates a ZMQ PUB socket bound to the given endpoints. If curveSecretKey (Z85) is set,
+// the socket acts as CURVE server only accepting clients with one of the given public keys (all if empty).
+func NewZMQSink(bindEndpoints []string, mode string, curveSecretKey string, curveClientKeys []string, linger time.Duration) (*ZMQSink, error) {
+	if mode != ZMQModeEMDR && mode != ZMQModeTopic {
+		return nil, fmt.Errorf("unknown ZMQ mode: %s", mode)
+	}
+
+	s, err := zmq4.NewSocket(zmq4.PUB)
+	if err != nil {
+		return nil, err
+	}
+
+	if curveSecretKey != "" {
+		err = setupCurve(s, curveSecretKey, curveClientKeys)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	for _, bindEndpoint := range bindEndpoints {
+		err = s.Bind(bindEndpoint)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("could not bind to %s: %s", bindEndpoint, err.Error())
+		}
+	}
+
+	return &ZMQSink{socket: s, mode: mode, linger: linger, curve: curveSecretKey != ""}, nil
+}
+
+// Enable CURVE encryption, authenticate clients by their public keys
+func setupCurve(s *zmq4.Socket, secretKey string, clientKeys []string) error {
+	err := zmq4.AuthStart()
+	if err != nil {
+		return err
+	}
+
+	if len(clientKeys) == 0 {
+		zmq4.AuthCurveAdd(zmqCurveDomain, zmq4.CURVE_ALLOW_ANY)
+	} else {
+		zmq4.AuthCurveAdd(zmqCurveDomain, clientKeys...)
+	}
+
+	return s.ServerAuthCurve(zmqCurveDomain, secretKey)
+}
+
+// Name returns the sink's name
+func (sink *ZMQSink) Name() string {
+	return "zmq"
+}
+
+// Publish sends the message's payload, prefixed by topic and header frames in topic mode
+func (sink *ZMQSink) Publish(message *Message) error {
+	if sink.mode == ZMQModeEMDR {
+		if message.Type != TypeSnapshot {
+			return nil
+		}
+
+		_, err := sink.socket.SendBytes(message.Payload, 0)
+		return err
+	}
+
+	header, err := json.Marshal(ZMQHeader{
+		Type:             message.Type.String(),
+		RegionID:         message.RegionID,
+		LastModified:     message.LastModified,
+		NextRun:          message.NextRun,
+		NumOrders:        message.NumOrders,
+		Inconsistent:     message.Inconsistent,
+		FailedStructures: message.FailedStructures,
+		Format:           message.Format,
+		Codec:            message.Codec,
+	})
+	if err != nil {
+		return err
+	}
+
+	topic := fmt.Sprintf("region:%d", message.RegionID)
+	if message.Type != TypeSnapshot {
+		topic = fmt.Sprintf("%s:%s", topic, message.Type)
+	}
+	_, err = sink.socket.SendMessage(topic, header, message.Payload)
+
+	return err
+}
+
+// Close closes the socket, blocking for up to the linger period until pending messages were sent
+func (sink *ZMQSink) Close() error {
+	err := sink.socket.SetLinger(sink.linger)
+	if err != nil {
+		return err
+	}
+
+	err = sink.socket.Close()
+	if err != nil {
+		return err
+	}
+
+	if sink.curve {
+		zmq4.AuthStop()
+	}
+
+	// Terminating the context waits for the linger period
+	return zmq4.Term()
+}
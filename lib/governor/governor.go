@@ -0,0 +1,201 @@
+package governor
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ESI allows 100 errors per window before banning clients
+const initialErrorBudget = 100
+
+var (
+	errorLimitRemain = expvar.NewInt("esiErrorLimitRemain")
+	errorLimitReset  = expvar.NewInt("esiErrorLimitReset")
+	numErrors        = expvar.NewInt("esiErrors")
+	numPauses        = expvar.NewInt("esiPauses")
+	paused           = expvar.NewInt("esiPaused")
+)
+
+// Governor is a http.RoundTripper tracking ESI's error budget, which pauses all requests once it runs low
+type Governor struct {
+	sync.Mutex
+	transport http.RoundTripper
+	threshold int64
+	timeout   time.Duration
+	remain    int64
+	resetAt   time.Time
+	// Requests which may still fail and use up the budget
+	inFlight int64
+	// Closed and replaced whenever a request finished
+	finished chan struct{}
+}
+
+// NewGovernor wraps transport, pausing requests while less than threshold errors remain until the budget resets.
+// Every request may take up to timeout once it was let through, time spent paused does not count.
+func NewGovernor(transport http.RoundTripper, threshold int64, timeout time.Duration) *Governor {
+	errorLimitRemain.Set(initialErrorBudget)
+
+	return &Governor{
+		transport: transport,
+		threshold: threshold,
+		timeout:   timeout,
+		remain:    initialErrorBudget,
+		finished:  make(chan struct{}),
+	}
+}
+
+// RoundTrip waits for the error budget if needed and then performs the request
+func (governor *Governor) RoundTrip(request *http.Request) (*http.Response, error) {
+	err := governor.wait(request.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if governor.timeout > 0 {
+		ctx, cancel = context.WithTimeout(request.Context(), governor.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(request.Context())
+	}
+
+	response, err := governor.transport.RoundTrip(request.WithContext(ctx))
+	if err != nil {
+		governor.release()
+		cancel()
+		return nil, err
+	}
+
+	governor.update(response)
+	governor.release()
+
+	// The timeout covers reading the body, too
+	response.Body = &cancelBody{ReadCloser: response.Body, cancel: cancel}
+
+	return response, nil
+}
+
+// Block until the request can be made without exceeding the error budget, even if all requests in flight fail,
+// or ctx is done
+func (governor *Governor) wait(ctx context.Context) error {
+	for {
+		governor.Lock()
+		remain := governor.remain
+		resetIn := time.Until(governor.resetAt)
+		finished := governor.finished
+
+		// The window was reset since the last response
+		if resetIn <= 0 {
+			remain = initialErrorBudget
+		}
+
+		if remain-governor.inFlight > governor.threshold {
+			governor.inFlight++
+			governor.Unlock()
+			return nil
+		}
+		inFlight := governor.inFlight
+		governor.Unlock()
+
+		// Wait for a request in flight to report the budget, or for the window to reset
+		var timer *time.Timer
+		var reset <-chan time.Time
+		if resetIn > 0 {
+			timer = time.NewTimer(resetIn)
+			reset = timer.C
+		}
+
+		if remain <= governor.threshold {
+			logrus.WithFields(logrus.Fields{
+				"errorLimitRemain": remain,
+				"resetIn":          resetIn,
+			}).Warn("ESI error budget low, pausing requests.")
+
+			numPauses.Add(1)
+		} else {
+			logrus.WithFields(logrus.Fields{
+				"errorLimitRemain": remain,
+				"inFlight":         inFlight,
+			}).Debug("ESI error budget reserved by requests in flight, waiting.")
+		}
+
+		paused.Add(1)
+		select {
+		case <-ctx.Done():
+		case <-reset:
+		case <-finished:
+		}
+		paused.Add(-1)
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// Give back the request's reservation and wake up waiting requests
+func (governor *Governor) release() {
+	governor.Lock()
+	governor.inFlight--
+	close(governor.finished)
+	governor.finished = make(chan struct{})
+	governor.Unlock()
+}
+
+// Cancels the request's timeout once its body was closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+
+	return err
+}
+
+// Update budget from ESI's error limit headers
+func (governor *Governor) update(response *http.Response) {
+	if response.StatusCode >= 400 {
+		numErrors.Add(1)
+	}
+
+	remain, err := strconv.ParseInt(response.Header.Get("X-Esi-Error-Limit-Remain"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	reset, err := strconv.ParseInt(response.Header.Get("X-Esi-Error-Limit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	governor.Lock()
+	governor.remain = remain
+	governor.resetAt = time.Now().Add(time.Duration(reset) * time.Second)
+	governor.Unlock()
+
+	errorLimitRemain.Set(remain)
+	errorLimitReset.Set(reset)
+
+	if remain <= governor.threshold {
+		logrus.WithFields(logrus.Fields{
+			"errorLimitRemain": remain,
+			"errorLimitReset":  reset,
+			"status":           response.StatusCode,
+			"url":              response.Request.URL.String(),
+		}).Warn("ESI error budget low!")
+	}
+}
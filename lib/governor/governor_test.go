@@ -0,0 +1,159 @@
+package governor
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Answers every request with the given error limit headers, blocking until release is closed
+type fakeTransport struct {
+	remain   string
+	reset    string
+	release  chan struct{}
+	inFlight int32
+	maxSeen  int32
+}
+
+func (transport *fakeTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	inFlight := atomic.AddInt32(&transport.inFlight, 1)
+	defer atomic.AddInt32(&transport.inFlight, -1)
+
+	for {
+		maxSeen := atomic.LoadInt32(&transport.maxSeen)
+		if inFlight <= maxSeen || atomic.CompareAndSwapInt32(&transport.maxSeen, maxSeen, inFlight) {
+			break
+		}
+	}
+
+	if transport.release != nil {
+		select {
+		case <-transport.release:
+		case <-request.Context().Done():
+			return nil, request.Context().Err()
+		}
+	}
+
+	response := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader("[]")),
+		Request:    request,
+	}
+	response.Header.Set("X-Esi-Error-Limit-Remain", transport.remain)
+	response.Header.Set("X-Esi-Error-Limit-Reset", transport.reset)
+
+	return response, nil
+}
+
+func newRequest(t *testing.T, ctx context.Context) *http.Request {
+	request, err := http.NewRequest(http.MethodGet, "https://esi.tech.ccp.is/latest/markets/10000002/orders/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return request.WithContext(ctx)
+}
+
+func TestReservation(t *testing.T) {
+	transport := &fakeTransport{remain: "100", reset: "60", release: make(chan struct{})}
+	governor := NewGovernor(transport, 20, time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := governor.RoundTrip(newRequest(t, context.Background()))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			response.Body.Close()
+		}()
+	}
+
+	// Give all requests the chance to pass the governor
+	time.Sleep(100 * time.Millisecond)
+	if inFlight := atomic.LoadInt32(&transport.inFlight); inFlight != 80 {
+		t.Errorf("got %d requests in flight, want 80", inFlight)
+	}
+
+	close(transport.release)
+	wg.Wait()
+
+	if transport.maxSeen > 80 {
+		t.Errorf("got up to %d requests in flight, budget allows 80", transport.maxSeen)
+	}
+}
+
+func TestPauseCancelled(t *testing.T) {
+	transport := &fakeTransport{remain: "10", reset: "60"}
+	governor := NewGovernor(transport, 20, time.Minute)
+
+	// Learn about the low budget
+	response, err := governor.RoundTrip(newRequest(t, context.Background()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = governor.RoundTrip(newRequest(t, ctx))
+	if err != context.DeadlineExceeded {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("paused request returned after %s despite its deadline", time.Since(start))
+	}
+}
+
+func TestPauseUntilReset(t *testing.T) {
+	transport := &fakeTransport{remain: "10", reset: "1"}
+	governor := NewGovernor(transport, 20, time.Minute)
+
+	response, err := governor.RoundTrip(newRequest(t, context.Background()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	// The window resets after a second, restoring the full budget
+	start := time.Now()
+	response, err = governor.RoundTrip(newRequest(t, context.Background()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	if time.Since(start) < 500*time.Millisecond {
+		t.Errorf("request was not paused until the budget reset")
+	}
+}
+
+func TestTimeoutExcludesPause(t *testing.T) {
+	transport := &fakeTransport{remain: "10", reset: "1"}
+	governor := NewGovernor(transport, 20, 200*time.Millisecond)
+
+	response, err := governor.RoundTrip(newRequest(t, context.Background()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	// Paused for about a second, longer than the timeout, but the request itself is quick
+	response, err = governor.RoundTrip(newRequest(t, context.Background()))
+	if err != nil {
+		t.Fatalf("request timed out while paused: %v", err)
+	}
+	response.Body.Close()
+}
@@ -0,0 +1,121 @@
+package leader
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// Giving up leadership is not retried, the lease expires after its TTL otherwise
+const resignTimeout = 2 * time.Second
+
+// EtcdBackend elects a leader using an etcd election, instances which stop refreshing their lease
+// (e.g. because they died) lose leadership once it expires
+type EtcdBackend struct {
+	client *clientv3.Client
+	prefix string
+	ttl    int
+
+	// Guards the current campaign's state, as Resign is called while campaigning
+	sync.Mutex
+	session        *concurrency.Session
+	election       *concurrency.Election
+	cancelCampaign context.CancelFunc
+	resigned       bool
+}
+
+// NewEtcdBackend connects to etcd, all instances campaign on the same key prefix. Leadership is lost
+// if the lease could not be refreshed within ttl seconds.
+func NewEtcdBackend(endpoints []string, prefix string, ttl int) (*EtcdBackend, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &EtcdBackend{
+		client: client,
+		prefix: prefix,
+		ttl:    ttl,
+	}, nil
+}
+
+// Name returns the backend's name
+func (backend *EtcdBackend) Name() string {
+	return "etcd"
+}
+
+// Campaign blocks until elected or resigned, leadership is lost with the session's lease
+func (backend *EtcdBackend) Campaign() (<-chan struct{}, error) {
+	backend.Lock()
+	if backend.resigned {
+		backend.Unlock()
+		return nil, errResigned
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	backend.cancelCampaign = cancel
+	backend.Unlock()
+
+	session, err := concurrency.NewSession(backend.client, concurrency.WithTTL(backend.ttl))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	election := concurrency.NewElection(session, backend.prefix)
+
+	err = election.Campaign(ctx, hostname)
+	if err != nil {
+		cancel()
+		session.Close()
+		return nil, err
+	}
+
+	backend.Lock()
+	defer backend.Unlock()
+
+	// Resigned while the campaign succeeded, give up the leadership right away
+	if ctx.Err() != nil {
+		session.Close()
+		return nil, errResigned
+	}
+
+	backend.session = session
+	backend.election = election
+
+	return session.Done(), nil
+}
+
+// Resign gives up leadership and revokes the session's lease, a running campaign is cancelled
+func (backend *EtcdBackend) Resign() error {
+	backend.Lock()
+	backend.resigned = true
+	if backend.cancelCampaign != nil {
+		backend.cancelCampaign()
+	}
+
+	session := backend.session
+	election := backend.election
+	backend.session = nil
+	backend.election = nil
+	backend.Unlock()
+
+	if session == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resignTimeout)
+	defer cancel()
+
+	err := election.Resign(ctx)
+	session.Close()
+
+	return err
+}
@@ -0,0 +1,82 @@
+package leader
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Period for retrying to get the lock
+const fileLockRetryPeriod = time.Second
+
+// FileBackend elects the instance holding an exclusive lock on a file, for instances on the same host
+type FileBackend struct {
+	path string
+
+	// Guards the lock's state, as Resign is called while campaigning
+	sync.Mutex
+	file     *os.File
+	resigned bool
+}
+
+// NewFileBackend creates a backend locking the file at path, it is created if missing
+func NewFileBackend(path string) *FileBackend {
+	return &FileBackend{path: path}
+}
+
+// Name returns the backend's name
+func (backend *FileBackend) Name() string {
+	return "file"
+}
+
+// Campaign blocks until the lock was acquired or resigned, the lock is held until resigning or the process exits
+func (backend *FileBackend) Campaign() (<-chan struct{}, error) {
+	file, err := os.OpenFile(backend.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		// Checked while holding the mutex, so the lock is never taken after resigning
+		backend.Lock()
+		if backend.resigned {
+			backend.Unlock()
+			file.Close()
+			return nil, errResigned
+		}
+
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			backend.file = file
+			backend.Unlock()
+			break
+		}
+		backend.Unlock()
+
+		if err != syscall.EWOULDBLOCK {
+			file.Close()
+			return nil, err
+		}
+
+		time.Sleep(fileLockRetryPeriod)
+	}
+
+	// Locks are only lost with the process
+	return make(chan struct{}), nil
+}
+
+// Resign releases the lock, a running campaign gives up
+func (backend *FileBackend) Resign() error {
+	backend.Lock()
+	defer backend.Unlock()
+
+	backend.resigned = true
+	if backend.file == nil {
+		return nil
+	}
+
+	err := backend.file.Close()
+	backend.file = nil
+	return err
+}
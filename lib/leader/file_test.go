@@ -0,0 +1,53 @@
+package leader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileBackendResignWhileCampaigning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "leader.lock")
+
+	leader := NewFileBackend(path)
+	_, err = leader.Campaign()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	standby := NewFileBackend(path)
+	result := make(chan error)
+	go func() {
+		_, err := standby.Campaign()
+		result <- err
+	}()
+
+	// The standby resigns while waiting for the lock, it must not take it once the leader is gone
+	time.Sleep(100 * time.Millisecond)
+	err = standby.Resign()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = leader.Resign()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-result:
+		if err != errResigned {
+			t.Errorf("got error %v, want %v", err, errResigned)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("campaign did not give up after resigning")
+	}
+}
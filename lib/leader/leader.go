@@ -0,0 +1,134 @@
+package leader
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Returned by campaigns after resigning, e.g. on shutdown
+var errResigned = errors.New("resigned from leader election")
+
+// Delay between campaigns after leadership was lost or a campaign failed
+const campaignRetryDelay = 5 * time.Second
+
+// Backend elects a single leader among all instances using the same backend
+type Backend interface {
+	Name() string
+
+	// Campaign blocks until this instance is elected, the returned channel is closed once
+	// leadership is lost
+	Campaign() (<-chan struct{}, error)
+
+	// Resign gives up leadership, if held
+	Resign() error
+}
+
+var (
+	isLeader = expvar.NewInt("leader")
+	terms    = expvar.NewInt("leaderTerms")
+)
+
+// Without a backend this instance is always the leader
+var state = struct {
+	sync.RWMutex
+	enabled bool
+	leader  bool
+	term    uint64
+	elected chan struct{}
+}{leader: true, elected: make(chan struct{})}
+
+// Initialize starts campaigning for leadership using backend, until elected this instance is standby
+func Initialize(backend Backend) {
+	state.Lock()
+	state.enabled = true
+	state.leader = false
+	state.Unlock()
+
+	isLeader.Set(0)
+
+	go campaign(backend)
+}
+
+// IsLeader returns whether this instance should scrape and publish
+func IsLeader() bool {
+	state.RLock()
+	defer state.RUnlock()
+	return state.leader
+}
+
+// Term returns the current term's number, which is increased every time this instance is elected
+func Term() uint64 {
+	state.RLock()
+	defer state.RUnlock()
+	return state.term
+}
+
+// IsCurrent returns whether this instance is still leader of the given term (used for fencing)
+func IsCurrent(term uint64) bool {
+	state.RLock()
+	defer state.RUnlock()
+	return state.leader && state.term == term
+}
+
+// Elected returns a channel which is closed the next time this instance is elected
+func Elected() <-chan struct{} {
+	state.RLock()
+	defer state.RUnlock()
+	return state.elected
+}
+
+// Resign gives up leadership, e.g. on shutdown
+func Resign(backend Backend) error {
+	setLeader(false)
+	return backend.Resign()
+}
+
+// Campaign for leadership until elected, then wait until leadership is lost and start over
+func campaign(backend Backend) {
+	for {
+		lost, err := backend.Campaign()
+		if err != nil {
+			logrus.WithError(err).WithField("backend", backend.Name()).Warn("Leader election failed.")
+			time.Sleep(campaignRetryDelay)
+			continue
+		}
+
+		setLeader(true)
+		logrus.WithFields(logrus.Fields{
+			"backend": backend.Name(),
+			"term":    Term(),
+		}).Info("Elected as leader.")
+
+		<-lost
+
+		setLeader(false)
+		logrus.WithField("backend", backend.Name()).Warn("Lost leadership.")
+		time.Sleep(campaignRetryDelay)
+	}
+}
+
+func setLeader(leader bool) {
+	state.Lock()
+	defer state.Unlock()
+
+	if !state.enabled || state.leader == leader {
+		return
+	}
+
+	state.leader = leader
+
+	if leader {
+		state.term++
+		terms.Set(int64(state.term))
+		isLeader.Set(1)
+
+		close(state.elected)
+		state.elected = make(chan struct{})
+	} else {
+		isLeader.Set(0)
+	}
+}
@@ -1,9 +1,11 @@
 package citadels
 
 import (
+	"context"
 	"sync"
 	"time"
 
+	"github.com/EVE-Tools/market-streamer/lib/leader"
 	"github.com/EVE-Tools/market-streamer/lib/locations/locationCache"
 	"github.com/antihax/goesi"
 	"github.com/sirupsen/logrus"
@@ -11,28 +13,38 @@ import (
 
 var esiClient *goesi.APIClient
 
+// Updating the list of citadels is cancelled after this timeout
+const updateTimeout = 5 * time.Minute
+
 // Maps a regionID to citadelIDs in that region
 var citadelsInRegion = struct {
 	sync.RWMutex
 	store map[int64][]int64
 }{store: make(map[int64][]int64)}
 
-// List of citadels which returned 403s, wiped every twelve hours
-var citadelBlacklist = struct {
+// Citadels whose market failed, skipped until their backoff ends
+var citadelBackoff = struct {
 	sync.RWMutex
-	store map[int64]bool
-}{store: make(map[int64]bool)}
+	store map[int64]backoffEntry
+}{store: make(map[int64]backoffEntry)}
+
+type backoffEntry struct {
+	failures int
+	retryAt  time.Time
+}
+
+// Backoff for failing citadels starts at one minute and is doubled up to twelve hours
+const minBackoff = time.Minute
+const maxBackoff = 12 * time.Hour
 
-// Initialize initializes the citadel updates
+// Initialize initializes the citadel updates, citadels are loaded by the leader on takeover (see Update)
 func Initialize(client *goesi.APIClient) {
 	esiClient = client
 
-	updateCitadels()
 	go scheduleCitadelUpdate()
-	go scheduleBlacklistWipe()
 }
 
-// GetCitadelsInRegions returns all public citadel's IDs in a given list of regionIDs (excluding blacklisted ones)
+// GetCitadelsInRegions returns all public citadel's IDs in a given list of regionIDs
 func GetCitadelsInRegions(regionIDs []int64) []int64 {
 	var ids []int64
 
@@ -43,61 +55,89 @@ func GetCitadelsInRegions(regionIDs []int64) []int64 {
 	return ids
 }
 
-// GetCitadelsInRegion returns all public citadel's IDs for a given regionID (excluding blacklisted ones)
+// GetCitadelsInRegion returns all public citadel's IDs for a given regionID
 func GetCitadelsInRegion(regionID int64) []int64 {
-	var ids []int64
 	citadelsInRegion.RLock()
-	citadelBlacklist.RLock()
+	ids := append([]int64(nil), citadelsInRegion.store[regionID]...)
+	citadelsInRegion.RUnlock()
+
+	return ids
+}
 
-	for _, citadelID := range citadelsInRegion.store[regionID] {
-		if !citadelBlacklist.store[citadelID] {
-			ids = append(ids, citadelID)
+// ReportFailure backs off a citadel whose market could not be fetched and returns when to retry it.
+// Forbidden markets (e.g. if we don't have access) are skipped for twelve hours right away, other
+// failures back off exponentially.
+func ReportFailure(id int64, forbidden bool) time.Time {
+	citadelBackoff.Lock()
+	entry := citadelBackoff.store[id]
+	entry.failures++
+
+	backoff := maxBackoff
+	if !forbidden && entry.failures < 20 {
+		backoff = minBackoff << uint(entry.failures-1)
+		if backoff > maxBackoff {
+			backoff = maxBackoff
 		}
 	}
 
-	citadelBlacklist.RUnlock()
-	citadelsInRegion.RUnlock()
-	return ids
+	entry.retryAt = time.Now().Add(backoff)
+	citadelBackoff.store[id] = entry
+	citadelBackoff.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"citadelID": id,
+		"failures":  entry.failures,
+		"forbidden": forbidden,
+		"retryIn":   backoff,
+	}).Debug("Backing off citadel.")
+
+	return entry.retryAt
 }
 
-// BlacklistCitadel blacklists a citadel (e.g. if we don't have access)
-func BlacklistCitadel(id int64) {
-	citadelBlacklist.Lock()
-	citadelBlacklist.store[id] = true
-	citadelBlacklist.Unlock()
+// RestoreBackoff backs off a citadel with a known number of failures until retryAt, e.g. after a restart
+func RestoreBackoff(id int64, failures int, retryAt time.Time) {
+	citadelBackoff.Lock()
+	citadelBackoff.store[id] = backoffEntry{
+		failures: failures,
+		retryAt:  retryAt,
+	}
+	citadelBackoff.Unlock()
 }
 
-// Schdeule and perform citadel update
+// ReportSuccess resets a citadel's backoff
+func ReportSuccess(id int64) {
+	citadelBackoff.Lock()
+	delete(citadelBackoff.store, id)
+	citadelBackoff.Unlock()
+}
+
+// Schdeule and perform citadel update while this instance is leader
 func scheduleCitadelUpdate() {
 	ticker := time.NewTicker(30 * time.Minute)
 	defer ticker.Stop()
 	for {
 		<-ticker.C
-		go updateCitadels()
-	}
-}
 
-// Schedule and perform blacklist wipe
-func scheduleBlacklistWipe() {
-	ticker := time.NewTicker(12 * time.Hour)
-	defer ticker.Stop()
-	for {
-		<-ticker.C
-		go wipeBlacklist()
+		if leader.IsLeader() {
+			go Update()
+		}
 	}
 }
 
-// Updates list of citadelIDs
-func updateCitadels() {
+// Update updates the list of citadelIDs
+func Update() {
 	logrus.Debug("Updating citadels.")
 
-	citadelIDs, err := getCitadelIDs()
+	ctx, cancel := context.WithTimeout(context.Background(), updateTimeout)
+	defer cancel()
+
+	citadelIDs, err := getCitadelIDs(ctx)
 	if err != nil {
 		logrus.WithError(err).Error("Could not get public citadels from ESI!")
 		return
 	}
 
-	citadels, err := locationCache.GetLocations(citadelIDs)
+	citadels, err := locationCache.GetLocations(ctx, citadelIDs)
 	if err != nil {
 		logrus.WithError(err).Error("Could not get citadels from location API!")
 		return
@@ -113,20 +153,9 @@ func updateCitadels() {
 	logrus.Debug("Citadel update done.")
 }
 
-// Wipes the blacklist
-func wipeBlacklist() {
-	logrus.Debug("Wiping citadel blacklist.")
-
-	citadelBlacklist.Lock()
-	citadelBlacklist.store = make(map[int64]bool)
-	citadelBlacklist.Unlock()
-
-	logrus.Debug("Done wiping citadel blacklist.")
-}
-
 // Get all citadels from ESI
-func getCitadelIDs() ([]int64, error) {
-	citadelIDs, _, err := esiClient.ESI.UniverseApi.GetUniverseStructures(nil, nil)
+func getCitadelIDs(ctx context.Context) ([]int64, error) {
+	citadelIDs, _, err := esiClient.ESI.UniverseApi.GetUniverseStructures(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -2,6 +2,7 @@ package locationCache
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"net/http"
 	"sync"
@@ -23,8 +24,9 @@ func Initialize(url string, client *http.Client) {
 	httpClient = client
 }
 
-// GetLocations returns a (cached) version of location info from the location endpoint
-func GetLocations(locationIDs []int64) (map[int64]*staticData.Location, error) {
+// GetLocations returns a (cached) version of location info from the location endpoint, the request is
+// cancelled once ctx is done
+func GetLocations(ctx context.Context, locationIDs []int64) (map[int64]*staticData.Location, error) {
 	// Deduplicate IDs
 	locationIDs = deduplicateIDs(locationIDs)
 
@@ -49,7 +51,13 @@ func GetLocations(locationIDs []int64) (map[int64]*staticData.Location, error) {
 			return nil, err
 		}
 
-		response, err := httpClient.Post(locationServiceURL, "application/json", bytes.NewBuffer(serializedRequest))
+		request, err := http.NewRequest(http.MethodPost, locationServiceURL, bytes.NewBuffer(serializedRequest))
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Content-Type", "application/json")
+
+		response, err := httpClient.Do(request.WithContext(ctx))
 		if err != nil {
 			return nil, err
 		}
@@ -1,55 +1,178 @@
 package regions
 
 import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/EVE-Tools/market-streamer/lib/leader"
 	"github.com/antihax/goesi"
 	"github.com/sirupsen/logrus"
 )
 
 var esiClient *goesi.APIClient
-var regionIDs []int64
 
-// Initialize initializes the region updates
-func Initialize(client *goesi.APIClient) {
+// Updating the list of regions is cancelled after this timeout
+const updateTimeout = 5 * time.Minute
+
+// RegionIDs with a market owned by this instance, replaced on every update
+var marketRegions = struct {
+	sync.RWMutex
+	regionIDs []int64
+}{}
+
+// Regions given by ID or name to include or exclude, in addition to the ones in filterPath
+var includeRegions []string
+var excludeRegions []string
+var filterPath string
+
+// This instance only owns regions hashed to shardIndex out of shardCount shards
+var shardIndex = 0
+var shardCount = 1
+
+// Maps a regionID to its name, only filled if names are used in filters
+var regionNames = struct {
+	sync.RWMutex
+	store map[int64]string
+}{store: make(map[int64]string)}
+
+func init() {
+	expvar.Publish("ownedRegions", expvar.Func(func() interface{} {
+		return GetMarketRegions()
+	}))
+}
+
+// Filter is the format of the filter file, entries are regionIDs or names
+type Filter struct {
+	Include []FilterEntry `json:"include"`
+	Exclude []FilterEntry `json:"exclude"`
+}
+
+// FilterEntry is a regionID or a region's name, given as JSON number or string
+type FilterEntry string
+
+// UnmarshalJSON accepts both numbers and strings
+func (entry *FilterEntry) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+
+	switch typed := value.(type) {
+	case string:
+		*entry = FilterEntry(typed)
+	case float64:
+		*entry = FilterEntry(strconv.FormatInt(int64(typed), 10))
+	default:
+		return fmt.Errorf("invalid region filter entry: %s", data)
+	}
+
+	return nil
+}
+
+// Initialize initializes the region updates. If include is not empty only those regions are used,
+// otherwise all regions with a market. Excluded regions are never used. Both lists can contain
+// regionIDs or names and are extended by the filter file at filterFile (if set) on every update. Regions
+// are loaded by the leader on takeover (see Update).
+func Initialize(client *goesi.APIClient, include []string, exclude []string, filterFile string) {
 	esiClient = client
+	includeRegions = include
+	excludeRegions = exclude
+	filterPath = filterFile
 
-	updateRegions()
 	go scheduleRegionUpdate()
 }
 
-// GetMarketRegions returns all regionIDs with a market
+// InitializeSharding makes this instance own only the regions hashed to shard index out of count
+// shards, must be called before Initialize
+func InitializeSharding(index int, count int) error {
+	if count < 1 || index < 0 || index >= count {
+		return fmt.Errorf("invalid shard %d of %d", index, count)
+	}
+
+	shardIndex = index
+	shardCount = count
+
+	return nil
+}
+
+// GetMarketRegions returns a copy of all regionIDs with a market owned by this instance
 func GetMarketRegions() []int64 {
+	marketRegions.RLock()
+	defer marketRegions.RUnlock()
+
+	regionIDs := make([]int64, len(marketRegions.regionIDs))
+	copy(regionIDs, marketRegions.regionIDs)
+
 	return regionIDs
 }
 
-// Keep ticking in own goroutine and spawn worker tasks.
+// GetShard returns this instance's shard index and the number of shards
+func GetShard() (int, int) {
+	return shardIndex, shardCount
+}
+
+// Keep ticking in own goroutine and spawn worker tasks while this instance is leader.
 func scheduleRegionUpdate() {
 	ticker := time.NewTicker(30 * time.Minute)
 	defer ticker.Stop()
 	for {
 		<-ticker.C
-		go updateRegions()
+
+		if !leader.IsLeader() {
+			continue
+		}
+
+		go func() {
+			err := Update()
+			if err != nil {
+				logrus.WithError(err).Error("Could not update market regions!")
+			}
+		}()
 	}
 }
 
-// Updates list of regionIDs
-func updateRegions() {
+// Update updates the list of regionIDs, the previous list is kept on error
+func Update() error {
 	logrus.Debug("Updating regions.")
 
-	regions, err := getMarketRegions()
+	ctx, cancel := context.WithTimeout(context.Background(), updateTimeout)
+	defer cancel()
+
+	regions, err := getMarketRegions(ctx)
 	if err != nil {
-		logrus.WithError(err).Error("Could not get regionIDs from ESI!")
-		return
+		return err
+	}
+
+	marketRegions.Lock()
+	changed := !equalRegions(marketRegions.regionIDs, regions)
+	marketRegions.regionIDs = regions
+	marketRegions.Unlock()
+
+	if changed {
+		logrus.WithFields(logrus.Fields{
+			"shardIndex": shardIndex,
+			"shardCount": shardCount,
+			"regionIDs":  regions,
+		}).Info("Owned regions changed.")
 	}
 
-	regionIDs = regions
-	logrus.Debug("Region update done.")
+	logrus.WithField("numRegions", len(regions)).Debug("Region update done.")
+
+	return nil
 }
 
 // Get all regionIDs from ESI
-func getRegionIDs() ([]int32, error) {
-	regionIDs, _, err := esiClient.ESI.UniverseApi.GetUniverseRegions(nil, nil)
+func getRegionIDs(ctx context.Context) ([]int32, error) {
+	regionIDs, _, err := esiClient.ESI.UniverseApi.GetUniverseRegions(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -57,20 +180,169 @@ func getRegionIDs() ([]int32, error) {
 	return regionIDs, nil
 }
 
-// Get all regions with a market (filter WH)
-func getMarketRegions() ([]int64, error) {
-	regionIDs, err := getRegionIDs()
+// Get all regions with a market (filter WH) or the included ones, without excluded regions
+func getMarketRegions(ctx context.Context) ([]int64, error) {
+	regionIDs, err := getRegionIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	include, exclude, err := getFilter()
 	if err != nil {
 		return nil, err
 	}
 
+	var names map[int64]string
+	if containsNames(include) || containsNames(exclude) {
+		names, err = getRegionNames(ctx, regionIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	var marketRegionIDs []int64
 	for _, regionID := range regionIDs {
-		// Filter invalid regions
-		if regionID < 11000000 && regionID != 10000004 && regionID != 10000019 {
-			marketRegionIDs = append(marketRegionIDs, int64(regionID))
+		id := int64(regionID)
+
+		if len(include) > 0 {
+			if !matches(include, id, names[id]) {
+				continue
+			}
+		} else if regionID >= 11000000 || regionID == 10000004 || regionID == 10000019 {
+			// Filter invalid regions
+			continue
+		}
+
+		if matches(exclude, id, names[id]) {
+			continue
+		}
+
+		if shardOf(id) != shardIndex {
+			continue
 		}
+
+		marketRegionIDs = append(marketRegionIDs, id)
 	}
 
 	return marketRegionIDs, nil
 }
+
+// Get include and exclude lists from config and the filter file, which is re-read on every update
+func getFilter() ([]string, []string, error) {
+	include := append([]string(nil), includeRegions...)
+	exclude := append([]string(nil), excludeRegions...)
+
+	if filterPath == "" {
+		return include, exclude, nil
+	}
+
+	data, err := ioutil.ReadFile(filterPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var filter Filter
+	err = json.Unmarshal(data, &filter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, entry := range filter.Include {
+		include = append(include, string(entry))
+	}
+
+	for _, entry := range filter.Exclude {
+		exclude = append(exclude, string(entry))
+	}
+
+	return include, exclude, nil
+}
+
+// Check if any of the entries is not a regionID
+func containsNames(entries []string) bool {
+	for _, entry := range entries {
+		if _, err := strconv.ParseInt(entry, 10, 64); err != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check if a region is in the list by ID or (case-insensitive) name
+func matches(entries []string, regionID int64, name string) bool {
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+
+		if id, err := strconv.ParseInt(entry, 10, 64); err == nil {
+			if id == regionID {
+				return true
+			}
+		} else if name != "" && strings.EqualFold(entry, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Get the names of regions from ESI, names which were already resolved are cached
+func getRegionNames(ctx context.Context, regionIDs []int32) (map[int64]string, error) {
+	names := make(map[int64]string)
+
+	for _, regionID := range regionIDs {
+		regionNames.RLock()
+		name, ok := regionNames.store[int64(regionID)]
+		regionNames.RUnlock()
+
+		if !ok {
+			region, _, err := esiClient.ESI.UniverseApi.GetUniverseRegionsRegionId(ctx, regionID, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			name = region.Name
+
+			regionNames.Lock()
+			regionNames.store[int64(regionID)] = name
+			regionNames.Unlock()
+		}
+
+		names[int64(regionID)] = name
+	}
+
+	return names, nil
+}
+
+// Rendezvous hashing: a region belongs to the shard with the highest hash, so changing the number of
+// shards only moves regions from or to added or removed shards
+func shardOf(regionID int64) int {
+	owner := 0
+	var ownerHash uint64
+
+	for shard := 0; shard < shardCount; shard++ {
+		hash := fnv.New64a()
+		fmt.Fprintf(hash, "%d:%d", regionID, shard)
+
+		if sum := hash.Sum64(); shard == 0 || sum > ownerHash {
+			owner = shard
+			ownerHash = sum
+		}
+	}
+
+	return owner
+}
+
+func equalRegions(a []int64, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for index := range a {
+		if a[index] != b[index] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,96 @@
+package regions
+
+import "testing"
+
+// K-space regions with a market and some wormhole regions
+func testRegions() []int64 {
+	var ids []int64
+	for id := int64(10000001); id <= 10000070; id++ {
+		ids = append(ids, id)
+	}
+	for id := int64(11000001); id <= 11000033; id++ {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+func assignShards(ids []int64, count int) map[int64]int {
+	shardCount = count
+	defer func() { shardCount = 1 }()
+
+	owners := make(map[int64]int)
+	for _, id := range ids {
+		owners[id] = shardOf(id)
+	}
+
+	return owners
+}
+
+func TestShardOf(t *testing.T) {
+	ids := testRegions()
+
+	for count := 1; count <= 16; count++ {
+		owners := assignShards(ids, count)
+		regionsPerShard := make([]int, count)
+
+		for id, owner := range owners {
+			if owner < 0 || owner >= count {
+				t.Fatalf("%d shards: region %d hashed to shard %d", count, id, owner)
+			}
+			regionsPerShard[owner]++
+		}
+
+		// Every shard should get some regions
+		for shard, numRegions := range regionsPerShard {
+			if count <= 8 && numRegions == 0 {
+				t.Errorf("%d shards: shard %d owns no regions", count, shard)
+			}
+		}
+
+		// Ownership must be stable across calls
+		for id, owner := range assignShards(ids, count) {
+			if owners[id] != owner {
+				t.Errorf("%d shards: region %d moved from shard %d to %d without a change", count, id, owners[id], owner)
+			}
+		}
+	}
+}
+
+func TestShardOfMinimalMovement(t *testing.T) {
+	ids := testRegions()
+
+	for count := 1; count < 16; count++ {
+		before := assignShards(ids, count)
+		after := assignShards(ids, count+1)
+
+		moved := 0
+		for _, id := range ids {
+			if before[id] == after[id] {
+				continue
+			}
+
+			// Only regions moving to the added shard may change their owner
+			if after[id] != count {
+				t.Errorf("%d to %d shards: region %d moved from shard %d to %d", count, count+1, id, before[id], after[id])
+			}
+			moved++
+		}
+
+		if moved == 0 {
+			t.Errorf("%d to %d shards: no region moved to the added shard", count, count+1)
+		}
+	}
+}
+
+func TestGetMarketRegionsCopy(t *testing.T) {
+	marketRegions.regionIDs = []int64{10000002, 10000043}
+	defer func() { marketRegions.regionIDs = nil }()
+
+	regionIDs := GetMarketRegions()
+	regionIDs[0] = 10000030
+
+	if marketRegions.regionIDs[0] != 10000002 {
+		t.Error("changing the returned regions changed the owned regions")
+	}
+}
@@ -1,56 +1,103 @@
 package marketTypes
 
 import (
+	"context"
+	"sync"
 	"time"
 
+	"github.com/EVE-Tools/market-streamer/lib/leader"
 	"github.com/antihax/goesi"
 	"github.com/sirupsen/logrus"
 )
 
 var esiClient *goesi.APIClient
 var esiSemaphore = make(chan struct{}, 200)
-var typeIDs []int64
 
-// Initialize initializes the market type updates
+// Market types and when they were last updated
+var typeList = struct {
+	sync.RWMutex
+	typeIDs []int64
+	updated time.Time
+}{}
+
+// Updating the list of types is cancelled after this timeout, as every type is checked it takes a while
+const updateTimeout = 30 * time.Minute
+
+// The list of types is refreshed this often while leader
+const updateInterval = 2 * time.Hour
+
+// Initialize initializes the market type updates, types are loaded by the leader on takeover (see Load)
 func Initialize(client *goesi.APIClient) {
 	esiClient = client
 
-	updateTypes()
 	go scheduleTypeUpdate()
 }
 
 // GetMarketTypes returns all typeIDs with a market
 func GetMarketTypes() []int64 {
-	return typeIDs
+	typeList.RLock()
+	defer typeList.RUnlock()
+	return typeList.typeIDs
+}
+
+// Load updates the type list unless it was updated recently, e.g. kept from a previous term
+func Load() error {
+	typeList.RLock()
+	outdated := time.Since(typeList.updated) > updateInterval
+	typeList.RUnlock()
+
+	if !outdated {
+		return nil
+	}
+
+	return updateTypes()
 }
 
-// Keep ticking in own goroutine and spawn worker tasks.
+// Keep ticking in own goroutine and spawn worker tasks while this instance is leader
 func scheduleTypeUpdate() {
-	ticker := time.NewTicker(2 * time.Hour)
+	ticker := time.NewTicker(updateInterval)
 	defer ticker.Stop()
 	for {
 		<-ticker.C
-		go updateTypes()
+
+		if !leader.IsLeader() {
+			continue
+		}
+
+		go func() {
+			err := updateTypes()
+			if err != nil {
+				logrus.WithError(err).Error("Failed to get market types!")
+			}
+		}()
 	}
 }
 
-// Update type list
-func updateTypes() {
+// Update type list, the previous list is kept on error
+func updateTypes() error {
 	logrus.Debug("Updating market types.")
 
-	types, err := getMarketTypes()
+	ctx, cancel := context.WithTimeout(context.Background(), updateTimeout)
+	defer cancel()
+
+	types, err := getMarketTypes(ctx)
 	if err != nil {
-		logrus.WithError(err).Error("Failed to get market types!")
-	} else {
-		typeIDs = types
+		return err
 	}
 
+	typeList.Lock()
+	typeList.typeIDs = types
+	typeList.updated = time.Now()
+	typeList.Unlock()
+
 	logrus.Debug("Market type update done.")
+
+	return nil
 }
 
 // Get all types on market
-func getMarketTypes() ([]int64, error) {
-	typeIDs, err := getTypeIDs()
+func getMarketTypes(ctx context.Context) ([]int64, error) {
+	typeIDs, err := getTypeIDs(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -62,7 +109,7 @@ func getMarketTypes() ([]int64, error) {
 	typesLeft := len(typeIDs)
 
 	for _, id := range typeIDs {
-		go checkIfMarketTypeAsyncRetry(id, marketTypes, nonMarketTypes, failure)
+		go checkIfMarketTypeAsyncRetry(ctx, id, marketTypes, nonMarketTypes, failure)
 	}
 
 	var marketTypeIDs []int64
@@ -79,17 +126,22 @@ func getMarketTypes() ([]int64, error) {
 		typesLeft--
 	}
 
+	// Checks failed because the update was cancelled or timed out, keep the previous list
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
 	return marketTypeIDs, nil
 }
 
 // Get all typeIDs from ESI
 // TODO: move to static-data RPC
-func getTypeIDs() ([]int32, error) {
+func getTypeIDs(ctx context.Context) ([]int32, error) {
 	var typeIDs []int32
 	params := make(map[string]interface{})
 	params["page"] = int32(1)
 
-	typeResult, _, err := esiClient.ESI.UniverseApi.GetUniverseTypes(nil, params)
+	typeResult, _, err := esiClient.ESI.UniverseApi.GetUniverseTypes(ctx, params)
 	if err != nil {
 		return nil, err
 	}
@@ -98,7 +150,7 @@ func getTypeIDs() ([]int32, error) {
 
 	for len(typeResult) > 0 {
 		params["page"] = params["page"].(int32) + 1
-		typeResult, _, err = esiClient.ESI.UniverseApi.GetUniverseTypes(nil, params)
+		typeResult, _, err = esiClient.ESI.UniverseApi.GetUniverseTypes(ctx, params)
 		if err != nil {
 			return nil, err
 		}
@@ -110,13 +162,13 @@ func getTypeIDs() ([]int32, error) {
 }
 
 // Async check if market type, retry 3 times
-func checkIfMarketTypeAsyncRetry(typeID int32, marketTypes chan int64, nonMarketTypes chan int64, failure chan error) {
+func checkIfMarketTypeAsyncRetry(ctx context.Context, typeID int32, marketTypes chan int64, nonMarketTypes chan int64, failure chan error) {
 	var isMarketType bool
 	var err error
 	retries := 3
 
 	for retries > 0 {
-		isMarketType, err = checkIfMarketType(typeID)
+		isMarketType, err = checkIfMarketType(ctx, typeID)
 		if err != nil {
 			retries--
 		} else {
@@ -139,9 +191,9 @@ func checkIfMarketTypeAsyncRetry(typeID int32, marketTypes chan int64, nonMarket
 }
 
 // Check if type is market type
-func checkIfMarketType(typeID int32) (bool, error) {
+func checkIfMarketType(ctx context.Context, typeID int32) (bool, error) {
 	esiSemaphore <- struct{}{}
-	typeInfo, _, err := esiClient.ESI.UniverseApi.GetUniverseTypesTypeId(nil, typeID, nil)
+	typeInfo, _, err := esiClient.ESI.UniverseApi.GetUniverseTypesTypeId(ctx, typeID, nil)
 	<-esiSemaphore
 	if err != nil {
 		return false, err
@@ -0,0 +1,185 @@
+package orderTracker
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EVE-Tools/emdr-to-nsq/lib/emds"
+	"github.com/EVE-Tools/market-streamer/lib/delta"
+)
+
+// EventType describes what happened to an order
+type EventType string
+
+// Event types
+const (
+	Created           EventType = "created"
+	Modified          EventType = "modified"
+	PartiallyFilled   EventType = "partiallyFilled"
+	FilledOrCancelled EventType = "filledOrCancelled"
+	Expired           EventType = "expired"
+)
+
+// Event is a change in an order's lifecycle between two snapshots
+type Event struct {
+	Type          EventType `json:"type"`
+	OrderID       int64     `json:"orderID"`
+	TypeID        int64     `json:"typeID"`
+	Bid           bool      `json:"bid"`
+	Price         float64   `json:"price"`
+	PreviousPrice float64   `json:"previousPrice,omitempty"`
+	Volume        int64     `json:"volume"`
+	StationID     int64     `json:"stationID"`
+}
+
+// TypeVolume is the volume of a type inferred to be traded between two snapshots. Traded is the
+// sum of partial fills, Closed the remaining volume of orders which were filled or cancelled
+// (an upper bound, as they can not be told apart).
+type TypeVolume struct {
+	TypeID int64 `json:"typeID"`
+	Traded int64 `json:"traded"`
+	Closed int64 `json:"closed"`
+}
+
+// Events holds all order events of a region between two snapshots
+type Events struct {
+	RegionID         int64        `json:"regionID"`
+	LastModified     time.Time    `json:"lastModified"`
+	BaseLastModified time.Time    `json:"baseLastModified"`
+	Events           []Event      `json:"events"`
+	Volumes          []TypeVolume `json:"volumes"`
+}
+
+var enabled bool
+
+// regionID -> last snapshot
+var snapshots = struct {
+	sync.Mutex
+	store map[int64]snapshot
+}{store: make(map[int64]snapshot)}
+
+type snapshot struct {
+	lastModified time.Time
+	orders       map[int64]emds.Order
+}
+
+// Initialize enables or disables order tracking
+func Initialize(enable bool) {
+	enabled = enable
+}
+
+// Update stores the region's current orders and returns the events since the last update (nil if
+// tracking is disabled or there was no previous update). Previous orders in unavailable locations
+// (e.g. citadels which failed to load) are carried over instead of being treated as gone.
+func Update(regionID int64, lastModified time.Time, rowsets []emds.Rowset, unavailableLocations map[int64]bool) *Events {
+	if !enabled {
+		return nil
+	}
+
+	orders := make(map[int64]emds.Order)
+	for _, rowset := range rowsets {
+		for _, order := range rowset.Rows {
+			orders[order.OrderID] = order
+		}
+	}
+
+	snapshots.Lock()
+	previous, ok := snapshots.store[regionID]
+
+	for orderID, order := range previous.orders {
+		if _, found := orders[orderID]; !found && unavailableLocations[order.StationID] {
+			orders[orderID] = order
+		}
+	}
+
+	snapshots.store[regionID] = snapshot{
+		lastModified: lastModified,
+		orders:       orders,
+	}
+	snapshots.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	added, changed, removed := delta.Compare(previous.orders, orders)
+	volumes := make(map[int64]*TypeVolume)
+	events := Events{
+		RegionID:         regionID,
+		LastModified:     lastModified,
+		BaseLastModified: previous.lastModified,
+	}
+
+	for _, order := range added {
+		events.Events = append(events.Events, newEvent(Created, order, order.VolRemaining))
+	}
+
+	for _, order := range changed {
+		previousOrder := previous.orders[order.OrderID]
+
+		if order.Price != previousOrder.Price {
+			event := newEvent(Modified, order, order.VolRemaining)
+			event.PreviousPrice = previousOrder.Price
+			events.Events = append(events.Events, event)
+		}
+
+		if order.VolRemaining < previousOrder.VolRemaining {
+			traded := previousOrder.VolRemaining - order.VolRemaining
+			events.Events = append(events.Events, newEvent(PartiallyFilled, order, traded))
+			getTypeVolume(volumes, order.TypeID).Traded += traded
+		}
+	}
+
+	for _, order := range removed {
+		if isExpired(order, lastModified) {
+			events.Events = append(events.Events, newEvent(Expired, order, order.VolRemaining))
+			continue
+		}
+
+		events.Events = append(events.Events, newEvent(FilledOrCancelled, order, order.VolRemaining))
+		getTypeVolume(volumes, order.TypeID).Closed += order.VolRemaining
+	}
+
+	for _, volume := range volumes {
+		events.Volumes = append(events.Volumes, *volume)
+	}
+
+	sort.Slice(events.Volumes, func(i, j int) bool {
+		return events.Volumes[i].TypeID < events.Volumes[j].TypeID
+	})
+
+	return &events
+}
+
+func newEvent(eventType EventType, order emds.Order, volume int64) Event {
+	return Event{
+		Type:      eventType,
+		OrderID:   order.OrderID,
+		TypeID:    order.TypeID,
+		Bid:       order.Bid,
+		Price:     order.Price,
+		Volume:    volume,
+		StationID: order.StationID,
+	}
+}
+
+func getTypeVolume(volumes map[int64]*TypeVolume, typeID int64) *TypeVolume {
+	if _, ok := volumes[typeID]; !ok {
+		volumes[typeID] = &TypeVolume{TypeID: typeID}
+	}
+
+	return volumes[typeID]
+}
+
+// Check if the order ran out of time before now, orders with unparsable dates never expire
+func isExpired(order emds.Order, now time.Time) bool {
+	issued, err := time.Parse(time.RFC3339, order.IssueDate)
+	if err != nil {
+		return false
+	}
+
+	expiry := issued.AddDate(0, 0, int(order.Duration))
+
+	return !expiry.After(now)
+}
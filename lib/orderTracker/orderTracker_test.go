@@ -0,0 +1,211 @@
+package orderTracker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/EVE-Tools/emdr-to-nsq/lib/emds"
+)
+
+var lastModified = time.Date(2017, 6, 1, 12, 30, 0, 0, time.UTC)
+
+func order(orderID int64, typeID int64, price float64, volRemaining int64, stationID int64) emds.Order {
+	return emds.Order{
+		OrderID:      orderID,
+		RegionID:     10000002,
+		TypeID:       typeID,
+		Price:        price,
+		VolRemaining: volRemaining,
+		IssueDate:    "2017-05-30T08:00:00+00:00",
+		Duration:     90,
+		StationID:    stationID,
+	}
+}
+
+func rowsets(orders ...emds.Order) []emds.Rowset {
+	return []emds.Rowset{{RegionID: 10000002, Rows: orders}}
+}
+
+func reset(enable bool) {
+	Initialize(enable)
+	snapshots.store = make(map[int64]snapshot)
+}
+
+func TestUpdate(t *testing.T) {
+	expiring := order(6, 36, 1, 5, 60003760)
+	expiring.IssueDate = "2017-05-31T12:30:00+00:00"
+	expiring.Duration = 1
+
+	tests := []struct {
+		name     string
+		previous []emds.Order
+		current  []emds.Order
+		events   []Event
+		volumes  []TypeVolume
+	}{
+		{
+			name:     "unchanged",
+			previous: []emds.Order{order(1, 34, 5, 100, 60003760)},
+			current:  []emds.Order{order(1, 34, 5, 100, 60003760)},
+		},
+		{
+			name:    "created",
+			current: []emds.Order{order(1, 34, 5, 100, 60003760)},
+			events:  []Event{{Type: Created, OrderID: 1, TypeID: 34, Price: 5, Volume: 100, StationID: 60003760}},
+		},
+		{
+			name:     "modified",
+			previous: []emds.Order{order(1, 34, 5, 100, 60003760)},
+			current:  []emds.Order{order(1, 34, 4.5, 100, 60003760)},
+			events:   []Event{{Type: Modified, OrderID: 1, TypeID: 34, Price: 4.5, PreviousPrice: 5, Volume: 100, StationID: 60003760}},
+		},
+		{
+			name:     "partially filled",
+			previous: []emds.Order{order(1, 34, 5, 100, 60003760)},
+			current:  []emds.Order{order(1, 34, 5, 60, 60003760)},
+			events:   []Event{{Type: PartiallyFilled, OrderID: 1, TypeID: 34, Price: 5, Volume: 40, StationID: 60003760}},
+			volumes:  []TypeVolume{{TypeID: 34, Traded: 40}},
+		},
+		{
+			name:     "modified and partially filled",
+			previous: []emds.Order{order(1, 34, 5, 100, 60003760)},
+			current:  []emds.Order{order(1, 34, 4.5, 60, 60003760)},
+			events: []Event{
+				{Type: Modified, OrderID: 1, TypeID: 34, Price: 4.5, PreviousPrice: 5, Volume: 60, StationID: 60003760},
+				{Type: PartiallyFilled, OrderID: 1, TypeID: 34, Price: 4.5, Volume: 40, StationID: 60003760},
+			},
+			volumes: []TypeVolume{{TypeID: 34, Traded: 40}},
+		},
+		{
+			name:     "filled or cancelled",
+			previous: []emds.Order{order(1, 34, 5, 100, 60003760)},
+			events:   []Event{{Type: FilledOrCancelled, OrderID: 1, TypeID: 34, Price: 5, Volume: 100, StationID: 60003760}},
+			volumes:  []TypeVolume{{TypeID: 34, Closed: 100}},
+		},
+		{
+			name:     "expired",
+			previous: []emds.Order{expiring},
+			events:   []Event{{Type: Expired, OrderID: 6, TypeID: 36, Price: 1, Volume: 5, StationID: 60003760}},
+		},
+		{
+			name:     "volumes per type",
+			previous: []emds.Order{order(1, 35, 5, 100, 60003760), order(2, 34, 5, 10, 60003760), order(3, 34, 5, 10, 60003760)},
+			current:  []emds.Order{order(1, 35, 5, 90, 60003760), order(2, 34, 5, 5, 60003760)},
+			events: []Event{
+				{Type: PartiallyFilled, OrderID: 1, TypeID: 35, Price: 5, Volume: 10, StationID: 60003760},
+				{Type: PartiallyFilled, OrderID: 2, TypeID: 34, Price: 5, Volume: 5, StationID: 60003760},
+				{Type: FilledOrCancelled, OrderID: 3, TypeID: 34, Price: 5, Volume: 10, StationID: 60003760},
+			},
+			volumes: []TypeVolume{{TypeID: 34, Traded: 5, Closed: 10}, {TypeID: 35, Traded: 10}},
+		},
+	}
+
+	for _, test := range tests {
+		reset(true)
+
+		if events := Update(10000002, lastModified.Add(-5*time.Minute), rowsets(test.previous...), nil); events != nil {
+			t.Errorf("%s: got events without previous snapshot", test.name)
+		}
+
+		events := Update(10000002, lastModified, rowsets(test.current...), nil)
+		if events == nil {
+			t.Fatalf("%s: got no events", test.name)
+		}
+
+		if !events.BaseLastModified.Equal(lastModified.Add(-5*time.Minute)) || !events.LastModified.Equal(lastModified) {
+			t.Errorf("%s: got base %s and last modified %s", test.name, events.BaseLastModified, events.LastModified)
+		}
+
+		if !containsEvents(events.Events, test.events) {
+			t.Errorf("%s: got events %+v, want %+v", test.name, events.Events, test.events)
+		}
+
+		if len(events.Volumes) != len(test.volumes) {
+			t.Errorf("%s: got volumes %+v, want %+v", test.name, events.Volumes, test.volumes)
+			continue
+		}
+
+		for i := range test.volumes {
+			if events.Volumes[i] != test.volumes[i] {
+				t.Errorf("%s: got volumes %+v, want %+v", test.name, events.Volumes, test.volumes)
+			}
+		}
+	}
+}
+
+// Events of different orders are not ordered, so compare them as sets
+func containsEvents(got []Event, want []Event) bool {
+	if len(got) != len(want) {
+		return false
+	}
+
+	for _, event := range want {
+		found := false
+		for _, candidate := range got {
+			if candidate == event {
+				found = true
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestUnavailableLocationsCarriedOver(t *testing.T) {
+	reset(true)
+
+	const citadelID = 1022734985679
+
+	Update(10000002, lastModified, rowsets(order(1, 34, 5, 100, 60003760), order(2, 34, 5, 100, citadelID)), nil)
+
+	// The citadel failed to load, its order must not be reported as filled or cancelled
+	events := Update(10000002, lastModified.Add(5*time.Minute), rowsets(order(1, 34, 5, 100, 60003760)), map[int64]bool{citadelID: true})
+	if events == nil || len(events.Events) != 0 {
+		t.Fatalf("got events %+v for unavailable citadel", events)
+	}
+
+	// Once the citadel is available again, changes are compared to the carried over order
+	events = Update(10000002, lastModified.Add(10*time.Minute), rowsets(order(1, 34, 5, 100, 60003760), order(2, 34, 5, 80, citadelID)), nil)
+	want := []Event{{Type: PartiallyFilled, OrderID: 2, TypeID: 34, Price: 5, Volume: 20, StationID: citadelID}}
+	if events == nil || !containsEvents(events.Events, want) {
+		t.Errorf("got events %+v, want %+v", events, want)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	reset(false)
+
+	Update(10000002, lastModified, rowsets(order(1, 34, 5, 100, 60003760)), nil)
+	if events := Update(10000002, lastModified, rowsets(), nil); events != nil {
+		t.Errorf("got events %+v while disabled", events)
+	}
+}
+
+func TestIsExpired(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		issueDate string
+		duration  int64
+		expired   bool
+	}{
+		{"running", "2017-05-30T12:00:00+00:00", 90, false},
+		{"ran out", "2017-05-01T11:00:00+00:00", 30, true},
+		{"ran out just now", "2017-05-31T12:00:00+00:00", 1, true},
+		{"runs out in a second", "2017-05-31T12:00:01+00:00", 1, false},
+		{"immediate", "2017-06-01T12:00:00+00:00", 0, true},
+		{"invalid issue date", "yesterday", 1, false},
+	}
+
+	for _, test := range tests {
+		order := emds.Order{IssueDate: test.issueDate, Duration: test.duration}
+		if isExpired(order, now) != test.expired {
+			t.Errorf("%s: got expired %t, want %t", test.name, !test.expired, test.expired)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package scheduler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/EVE-Tools/market-streamer/lib/locations/regions"
+	"github.com/sirupsen/logrus"
+)
+
+// Set if the whole scheduler is paused
+var paused int32
+
+// RegionStatus describes a region's schedule as returned by the admin API
+type RegionStatus struct {
+	RegionID     int64     `json:"regionID"`
+	NextRun      time.Time `json:"nextRun"`
+	LastModified time.Time `json:"lastModified"`
+	LastRun      time.Time `json:"lastRun"`
+	LastDuration string    `json:"lastDuration"`
+	LastError    string    `json:"lastError,omitempty"`
+	NumOrders    int       `json:"numOrders"`
+	Failures     int       `json:"failures"`
+	Paused       bool      `json:"paused"`
+	Refresh      bool      `json:"refresh"`
+	Priority     int       `json:"priority"`
+	HighPriority bool      `json:"highPriority"`
+}
+
+// ShardStatus describes the regions owned by this instance as returned by the admin API
+type ShardStatus struct {
+	Index     int     `json:"index"`
+	Count     int     `json:"count"`
+	RegionIDs []int64 `json:"regionIDs"`
+}
+
+// AdminHandler serves the admin API below /admin/, requests must carry the token as bearer token if set:
+//
+//	GET  /admin/regions                    schedule of all regions
+//	GET  /admin/regions/<id>               schedule of a single region
+//	POST /admin/regions/<id>/refresh       scrape the region now and publish it even if unchanged
+//	POST /admin/regions/<id>/pause         stop scraping the region
+//	POST /admin/regions/<id>/resume        resume scraping the region
+//	POST /admin/regions/<id>/priority?value=<priority>
+//	                                       set the region's priority, higher priorities are dispatched first
+//	GET  /admin/shard                      this instance's shard and owned regions
+//	GET  /admin/scheduler                  whether the scheduler is paused
+//	POST /admin/scheduler/pause            stop scraping all regions
+//	POST /admin/scheduler/resume           resume scraping
+type AdminHandler struct {
+	token string
+}
+
+// NewAdminHandler creates the admin API's handler, which should be mounted on /admin/
+func NewAdminHandler(token string) *AdminHandler {
+	return &AdminHandler{token: token}
+}
+
+// ServeHTTP dispatches admin requests
+func (handler *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler.token != "" {
+		authorization := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(authorization, []byte("Bearer "+handler.token)) != 1 {
+			http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin"), "/"), "/")
+
+	switch {
+	case len(path) == 1 && path[0] == "regions":
+		handler.getRegions(w, r)
+	case len(path) >= 2 && path[0] == "regions":
+		regionID, err := strconv.ParseInt(path[1], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid region ID.", http.StatusBadRequest)
+			return
+		}
+
+		if len(path) == 2 {
+			handler.getRegion(w, r, regionID)
+			return
+		}
+
+		if len(path) == 3 {
+			handler.controlRegion(w, r, regionID, path[2])
+			return
+		}
+
+		http.NotFound(w, r)
+	case len(path) == 1 && path[0] == "shard":
+		if !requireMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		index, count := regions.GetShard()
+		writeJSON(w, ShardStatus{
+			Index:     index,
+			Count:     count,
+			RegionIDs: regions.GetMarketRegions(),
+		})
+	case len(path) == 1 && path[0] == "scheduler":
+		if !requireMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		writeJSON(w, map[string]bool{"paused": atomic.LoadInt32(&paused) == 1})
+	case len(path) == 2 && path[0] == "scheduler":
+		handler.controlScheduler(w, r, path[1])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// List all regions' status ordered by ID
+func (handler *AdminHandler) getRegions(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	var statuses []RegionStatus
+
+	regionUpdateSchedule.RLock()
+	for regionID, entry := range regionUpdateSchedule.store {
+		statuses = append(statuses, newRegionStatus(regionID, entry))
+	}
+	regionUpdateSchedule.RUnlock()
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].RegionID < statuses[j].RegionID
+	})
+
+	writeJSON(w, statuses)
+}
+
+// Get a single region's status
+func (handler *AdminHandler) getRegion(w http.ResponseWriter, r *http.Request, regionID int64) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	regionUpdateSchedule.RLock()
+	entry, ok := regionUpdateSchedule.store[regionID]
+	regionUpdateSchedule.RUnlock()
+
+	if !ok {
+		http.Error(w, "Unknown region.", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, newRegionStatus(regionID, entry))
+}
+
+// Refresh, pause, resume or prioritize a region
+func (handler *AdminHandler) controlRegion(w http.ResponseWriter, r *http.Request, regionID int64, action string) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var priority int
+	if action == "priority" {
+		var err error
+		priority, err = strconv.Atoi(r.URL.Query().Get("value"))
+		if err != nil {
+			http.Error(w, "Invalid priority.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	regionUpdateSchedule.Lock()
+	entry, ok := regionUpdateSchedule.store[regionID]
+	if !ok {
+		regionUpdateSchedule.Unlock()
+		http.Error(w, "Unknown region.", http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "refresh":
+		// Forget last modified time, so that the market is published even if it did not change. If the region
+		// is queued or running, it is scraped again afterwards.
+		entry.runAgain = time.Now()
+		entry.lastModified = time.Time{}
+		entry.refresh = true
+	case "pause":
+		entry.paused = true
+	case "resume":
+		entry.paused = false
+	case "priority":
+		entry.priority = priority
+	default:
+		regionUpdateSchedule.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+
+	regionUpdateSchedule.store[regionID] = entry
+	regionUpdateSchedule.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"regionID": regionID,
+		"action":   action,
+	}).Info("Region changed by admin.")
+
+	writeJSON(w, newRegionStatus(regionID, entry))
+}
+
+// Pause or resume the whole scheduler
+func (handler *AdminHandler) controlScheduler(w http.ResponseWriter, r *http.Request, action string) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	switch action {
+	case "pause":
+		atomic.StoreInt32(&paused, 1)
+	case "resume":
+		atomic.StoreInt32(&paused, 0)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	logrus.WithField("action", action).Info("Scheduler changed by admin.")
+
+	writeJSON(w, map[string]bool{"paused": atomic.LoadInt32(&paused) == 1})
+}
+
+func newRegionStatus(regionID int64, entry scheduleEntry) RegionStatus {
+	return RegionStatus{
+		RegionID:     regionID,
+		NextRun:      entry.runAgain,
+		LastModified: entry.lastModified,
+		LastRun:      entry.lastRun,
+		LastDuration: entry.lastDuration.String(),
+		LastError:    entry.lastError,
+		NumOrders:    entry.numOrders,
+		Failures:     entry.failures,
+		Paused:       entry.paused,
+		Refresh:      entry.refresh,
+		Priority:     entry.priority,
+		HighPriority: highPriorityRegions[regionID],
+	}
+}
+
+// Reply with 405 if the request's method does not match
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return false
+	}
+
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		logrus.WithError(err).Warn("Could not write admin response.")
+	}
+}
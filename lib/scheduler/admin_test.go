@@ -0,0 +1,59 @@
+package scheduler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func refresh(t *testing.T, regionID string) {
+	request := httptest.NewRequest(http.MethodPost, "/admin/regions/"+regionID+"/refresh", nil)
+	recorder := httptest.NewRecorder()
+	NewAdminHandler("").ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", recorder.Code, http.StatusOK)
+	}
+}
+
+func TestRefreshWhileRunning(t *testing.T) {
+	lastModified := time.Date(2017, 6, 1, 12, 30, 0, 0, time.UTC)
+	regionUpdateSchedule.store = map[int64]scheduleEntry{
+		10000002: {runAgain: time.Now().Add(time.Minute), lastModified: lastModified},
+	}
+
+	// The region is still being scraped
+	pool.pending = map[string]bool{"region:10000002": true}
+	defer func() {
+		pool.pending = make(map[string]bool)
+		pool.queue = nil
+	}()
+
+	refresh(t, "10000002")
+
+	// The job can not be queued again, the refresh must be kept
+	updateMarkets()
+	if !regionUpdateSchedule.store[10000002].refresh {
+		t.Fatal("refresh dropped while the region was running")
+	}
+
+	// The running scrape finishes and reschedules the region
+	ScheduleRegion(10000002, time.Now().Add(5*time.Minute), lastModified)
+	entry := regionUpdateSchedule.store[10000002]
+	if entry.runAgain.After(time.Now()) || !entry.lastModified.IsZero() {
+		t.Errorf("got next run %s and last modified %s, want immediate refresh", entry.runAgain, entry.lastModified)
+	}
+
+	// Once the refresh is queued, the schedule is up to the scrape again
+	delete(pool.pending, "region:10000002")
+	updateMarkets()
+	if regionUpdateSchedule.store[10000002].refresh {
+		t.Error("refresh kept after it was queued")
+	}
+
+	ScheduleRegion(10000002, time.Now().Add(5*time.Minute), lastModified)
+	if entry := regionUpdateSchedule.store[10000002]; !entry.lastModified.Equal(lastModified) {
+		t.Errorf("got last modified %s, want %s", entry.lastModified, lastModified)
+	}
+}
@@ -0,0 +1,140 @@
+package scheduler
+
+import (
+	"container/heap"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Regions refreshed before all others with the same priority, e.g. trade hubs
+var highPriorityRegions = make(map[int64]bool)
+
+// Due scrapes waiting for a worker, ordered by priority
+var pool = struct {
+	sync.Mutex
+	cond    *sync.Cond
+	queue   jobQueue
+	pending map[string]bool
+	stopped bool
+	workers sync.WaitGroup
+}{pending: make(map[string]bool)}
+
+func init() {
+	pool.cond = sync.NewCond(&pool.Mutex)
+
+	expvar.Publish("scrapeQueueLength", expvar.Func(func() interface{} {
+		pool.Lock()
+		defer pool.Unlock()
+		return len(pool.queue)
+	}))
+}
+
+// A due scrape of a region or structure
+type scrapeJob struct {
+	key          string
+	priority     int
+	highPriority bool
+	due          time.Time
+	run          func()
+}
+
+// Start a fixed number of workers processing the queue
+func startWorkers(concurrency int) {
+	if concurrency < 1 {
+		logrus.Fatalf("Invalid scrape concurrency: %d", concurrency)
+	}
+
+	pool.workers.Add(concurrency)
+	for worker := 0; worker < concurrency; worker++ {
+		go runWorker()
+	}
+}
+
+// Drop queued jobs and let workers exit after their current job
+func stopWorkers() {
+	pool.Lock()
+	pool.stopped = true
+	pool.queue = nil
+	pool.cond.Broadcast()
+	pool.Unlock()
+}
+
+// Run jobs from the queue, highest priority first, until stopped
+func runWorker() {
+	defer pool.workers.Done()
+
+	for {
+		pool.Lock()
+		for len(pool.queue) == 0 && !pool.stopped {
+			pool.cond.Wait()
+		}
+
+		if pool.stopped {
+			pool.Unlock()
+			return
+		}
+
+		job := heap.Pop(&pool.queue).(*scrapeJob)
+		pool.Unlock()
+
+		job.run()
+
+		pool.Lock()
+		delete(pool.pending, job.key)
+		pool.Unlock()
+	}
+}
+
+// Queue a job unless a job with the same key is still queued or running, returns whether it was queued
+func enqueue(job *scrapeJob) bool {
+	pool.Lock()
+	defer pool.Unlock()
+
+	if pool.pending[job.key] || pool.stopped {
+		return false
+	}
+
+	pool.pending[job.key] = true
+	heap.Push(&pool.queue, job)
+	pool.cond.Signal()
+
+	return true
+}
+
+// Heap of jobs ordered by priority, then by class, then by due time
+type jobQueue []*scrapeJob
+
+func (queue jobQueue) Len() int {
+	return len(queue)
+}
+
+func (queue jobQueue) Less(i, j int) bool {
+	if queue[i].priority != queue[j].priority {
+		return queue[i].priority > queue[j].priority
+	}
+
+	if queue[i].highPriority != queue[j].highPriority {
+		return queue[i].highPriority
+	}
+
+	return queue[i].due.Before(queue[j].due)
+}
+
+func (queue jobQueue) Swap(i, j int) {
+	queue[i], queue[j] = queue[j], queue[i]
+}
+
+func (queue *jobQueue) Push(job interface{}) {
+	*queue = append(*queue, job.(*scrapeJob))
+}
+
+func (queue *jobQueue) Pop() interface{} {
+	old := *queue
+	job := old[len(old)-1]
+	old[len(old)-1] = nil
+	*queue = old[:len(old)-1]
+	return job
+}
@@ -0,0 +1,116 @@
+package scheduler
+
+import (
+	"expvar"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/EVE-Tools/market-streamer/lib/scraper"
+	"github.com/sirupsen/logrus"
+)
+
+// RetryPolicy configures backoff for regions which failed to scrape
+type RetryPolicy struct {
+	// Delay after the first transient failure, doubled for every subsequent one
+	BaseDelay time.Duration
+
+	// Upper bound for transient failures' delay
+	MaxDelay time.Duration
+
+	// Number of consecutive failures after which a region is considered unhealthy
+	UnhealthyThreshold int
+
+	// Delay for unhealthy regions and non-transient failures
+	UnhealthyDelay time.Duration
+}
+
+var retryPolicy = RetryPolicy{
+	BaseDelay:          15 * time.Second,
+	MaxDelay:           5 * time.Minute,
+	UnhealthyThreshold: 5,
+	UnhealthyDelay:     10 * time.Minute,
+}
+
+// regionID -> number of consecutive failures
+var regionFailures = expvar.NewMap("regionFailures")
+
+// Record a failed scrape and re-schedule the region according to the retry policy
+func recordFailure(regionID int64, err error) {
+	regionUpdateSchedule.Lock()
+	entry := regionUpdateSchedule.store[regionID]
+	entry.failures++
+	entry.lastError = err.Error()
+
+	delay := retryDelay(entry.failures, isTransient(err))
+	entry.runAgain = time.Now().Add(delay)
+
+	becameUnhealthy := entry.failures == retryPolicy.UnhealthyThreshold
+	failures := entry.failures
+	regionUpdateSchedule.store[regionID] = entry
+	regionUpdateSchedule.Unlock()
+
+	setRegionFailures(regionID, failures)
+
+	logger := logrus.WithError(err).WithFields(logrus.Fields{
+		"regionID": regionID,
+		"failures": failures,
+		"retryIn":  delay,
+	})
+
+	if becameUnhealthy {
+		logger.Error("Region unhealthy.")
+	} else {
+		logger.Warn("Failed to scrape market.")
+	}
+}
+
+// Reset failures after a successful scrape
+func recordSuccess(regionID int64) {
+	regionUpdateSchedule.Lock()
+	entry := regionUpdateSchedule.store[regionID]
+	wasUnhealthy := entry.failures >= retryPolicy.UnhealthyThreshold
+	entry.failures = 0
+	entry.lastError = ""
+	regionUpdateSchedule.store[regionID] = entry
+	regionUpdateSchedule.Unlock()
+
+	setRegionFailures(regionID, 0)
+
+	if wasUnhealthy {
+		logrus.WithField("regionID", regionID).Info("Region recovered.")
+	}
+}
+
+// Exponential backoff with jitter for transient failures, long backoff otherwise
+func retryDelay(failures int, transient bool) time.Duration {
+	delay := retryPolicy.UnhealthyDelay
+
+	if transient && failures < retryPolicy.UnhealthyThreshold {
+		delay = retryPolicy.BaseDelay << uint(failures-1)
+		if delay > retryPolicy.MaxDelay || delay <= 0 {
+			delay = retryPolicy.MaxDelay
+		}
+	}
+
+	// +/- 20% jitter so failing regions do not retry in lockstep
+	jitter := 0.8 + rand.Float64()*0.4
+	return time.Duration(float64(delay) * jitter)
+}
+
+// Only client errors returned by ESI (except rate limits) are not worth retrying quickly, everything
+// else (server errors, timeouts, failed location lookups) is assumed to be transient
+func isTransient(err error) bool {
+	if esiErr, ok := err.(*scraper.ESIError); ok && esiErr.StatusCode >= 400 && esiErr.StatusCode < 500 {
+		return esiErr.StatusCode == 420 || esiErr.StatusCode == 429
+	}
+
+	return true
+}
+
+// Expose number of consecutive failures per region
+func setRegionFailures(regionID int64, failures int) {
+	value := new(expvar.Int)
+	value.Set(int64(failures))
+	regionFailures.Set(strconv.FormatInt(regionID, 10), value)
+}
@@ -0,0 +1,115 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/EVE-Tools/market-streamer/lib/scraper"
+)
+
+func TestRetryDelay(t *testing.T) {
+	retryPolicy = RetryPolicy{
+		BaseDelay:          15 * time.Second,
+		MaxDelay:           5 * time.Minute,
+		UnhealthyThreshold: 8,
+		UnhealthyDelay:     10 * time.Minute,
+	}
+
+	tests := []struct {
+		failures  int
+		transient bool
+		delay     time.Duration
+	}{
+		{1, true, 15 * time.Second},
+		{2, true, 30 * time.Second},
+		{3, true, time.Minute},
+		{5, true, 4 * time.Minute},
+		// Capped at MaxDelay
+		{6, true, 5 * time.Minute},
+		{7, true, 5 * time.Minute},
+		// Unhealthy
+		{8, true, 10 * time.Minute},
+		{50, true, 10 * time.Minute},
+		// Shifting by this much overflows
+		{70, true, 10 * time.Minute},
+		// Non-transient failures always wait long
+		{1, false, 10 * time.Minute},
+		{8, false, 10 * time.Minute},
+	}
+
+	for _, test := range tests {
+		min := time.Duration(float64(test.delay) * 0.8)
+		max := time.Duration(float64(test.delay) * 1.2)
+
+		// Jitter is random, so sample a few times
+		for i := 0; i < 100; i++ {
+			delay := retryDelay(test.failures, test.transient)
+			if delay < min || delay > max {
+				t.Errorf("%d failures (transient %t): got delay %s, want %s to %s", test.failures, test.transient, delay, min, max)
+				break
+			}
+		}
+	}
+}
+
+func TestRetryDelayOverflow(t *testing.T) {
+	retryPolicy = RetryPolicy{
+		BaseDelay:          time.Hour,
+		MaxDelay:           24 * time.Hour,
+		UnhealthyThreshold: 100,
+		UnhealthyDelay:     48 * time.Hour,
+	}
+
+	// The shifted delay overflows, which must not result in a negative or zero delay
+	for _, failures := range []int{30, 40, 64, 65, 99} {
+		delay := retryDelay(failures, true)
+		if delay < time.Duration(float64(24*time.Hour)*0.8) || delay > time.Duration(float64(24*time.Hour)*1.2) {
+			t.Errorf("%d failures: got delay %s, want MaxDelay", failures, delay)
+		}
+	}
+}
+
+func TestRetryDelayJitter(t *testing.T) {
+	retryPolicy = RetryPolicy{
+		BaseDelay:          15 * time.Second,
+		MaxDelay:           5 * time.Minute,
+		UnhealthyThreshold: 5,
+		UnhealthyDelay:     10 * time.Minute,
+	}
+
+	delays := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		delays[retryDelay(1, true)] = true
+	}
+
+	if len(delays) < 2 {
+		t.Error("retry delays are not jittered")
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"bad request", &scraper.ESIError{StatusCode: 400, Err: errors.New("400")}, false},
+		{"forbidden", &scraper.ESIError{StatusCode: 403, Err: errors.New("403")}, false},
+		{"not found", &scraper.ESIError{StatusCode: 404, Err: errors.New("404")}, false},
+		{"error limited", &scraper.ESIError{StatusCode: 420, Err: errors.New("420")}, true},
+		{"rate limited", &scraper.ESIError{StatusCode: 429, Err: errors.New("429")}, true},
+		{"server error", &scraper.ESIError{StatusCode: 500, Err: errors.New("500")}, true},
+		{"bad gateway", &scraper.ESIError{StatusCode: 502, Err: errors.New("502")}, true},
+		{"gateway timeout", &scraper.ESIError{StatusCode: 504, Err: errors.New("504")}, true},
+		{"scrape timeout", context.DeadlineExceeded, true},
+		{"connection error", errors.New("connection reset by peer"), true},
+	}
+
+	for _, test := range tests {
+		if isTransient(test.err) != test.transient {
+			t.Errorf("%s: got transient %t, want %t", test.name, !test.transient, test.transient)
+		}
+	}
+}
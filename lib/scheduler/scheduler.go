@@ -1,16 +1,25 @@
 package scheduler
 
 import (
+	"context"
+	"fmt"
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/EVE-Tools/market-streamer/lib/emdr"
+	"github.com/EVE-Tools/market-streamer/lib/leader"
 	"github.com/EVE-Tools/market-streamer/lib/locations/regions"
 	"github.com/EVE-Tools/market-streamer/lib/scraper"
 	"github.com/sirupsen/logrus"
 )
 
-var upstream chan<- []byte
+var upstream chan<- *emdr.Message
+
+// Scrapes are cancelled once scrapeContext is done or after scrapeTimeout
+var scrapeContext = context.Background()
+var scrapeTimeout = 5 * time.Minute
 
 // regionID -> Update time, last modified time
 var regionUpdateSchedule = struct {
@@ -21,45 +30,135 @@ var regionUpdateSchedule = struct {
 type scheduleEntry struct {
 	runAgain     time.Time
 	lastModified time.Time
+	failures     int
+	lastRun      time.Time
+	lastDuration time.Duration
+	lastError    string
+	numOrders    int
+	paused       bool
+	priority     int
+	// Set by the admin API until a scrape without last modified time is queued
+	refresh bool
 }
 
-// Initialize initializes the market and region update scheduling
-func Initialize(emdr chan<- []byte) {
-	upstream = emdr
-	regionIDs := regions.GetMarketRegions()
+// Options configures the scheduler
+type Options struct {
+	// Scheduling stops once Context is done (see Shutdown)
+	Context context.Context
 
-	regionUpdateSchedule.Lock()
-	for _, regionID := range regionIDs {
-		randomOffset := time.Now().Add(time.Second * time.Duration(rand.Intn(300)))
-		regionUpdateSchedule.store[regionID] = scheduleEntry{
-			runAgain:     randomOffset,
-			lastModified: time.Time{},
+	// Running scrapes are cancelled once ScrapeContext is done or they took longer than ScrapeTimeout
+	ScrapeContext context.Context
+	ScrapeTimeout time.Duration
+
+	RetryPolicy RetryPolicy
+
+	// The schedule is persisted to StatePath if set
+	StatePath string
+
+	// At most Concurrency markets are scraped at the same time, HighPriorityRegions first
+	Concurrency         int
+	HighPriorityRegions []int64
+}
+
+// Initialize initializes the market and region update scheduling, scraped messages are sent to messages.
+// Unset contexts and timeouts default to context.Background() and 5 minutes.
+func Initialize(messages chan<- *emdr.Message, options Options) {
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if options.ScrapeContext != nil {
+		scrapeContext = options.ScrapeContext
+	}
+
+	if options.ScrapeTimeout > 0 {
+		scrapeTimeout = options.ScrapeTimeout
+	}
+
+	upstream = messages
+	retryPolicy = options.RetryPolicy
+	statePath = options.StatePath
+
+	for _, regionID := range options.HighPriorityRegions {
+		highPriorityRegions[regionID] = true
+	}
+
+	// Standby instances take over once elected
+	elected := leader.Elected()
+	if leader.IsLeader() {
+		go takeOver(ctx, leader.Term())
+	}
+
+	startWorkers(options.Concurrency)
+	go scheduleRegionUpdate(ctx)
+	go scheduleMarketUpdate(ctx, elected)
+
+	if statePath != "" {
+		go scheduleStateSave(ctx)
+	}
+
+	go func() {
+		<-ctx.Done()
+		stopWorkers()
+	}()
+}
+
+// Shutdown waits for in-flight scrapes to finish until ctx is done and saves the state, scheduling
+// has to be stopped by cancelling Initialize's context first
+func Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		pool.workers.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// Scrapes which did not finish are retried after the restart
+	if statePath != "" && isReady() {
+		stateErr := saveState()
+		if stateErr != nil {
+			logrus.WithError(stateErr).Warn("Could not save scheduler state!")
 		}
 	}
-	regionUpdateSchedule.Unlock()
 
-	updateRegions()
-	go scheduleRegionUpdate()
-	go scheduleMarketUpdate()
+	return err
 }
 
-// ScheduleRegion schedules the regionID for update at a specific time
+// ScheduleRegion schedules the regionID for update at a specific time, unless a refresh was requested
+// meanwhile
 func ScheduleRegion(regionID int64, runAgain time.Time, lastModified time.Time) {
 	regionUpdateSchedule.Lock()
 	cacheEntry := regionUpdateSchedule.store[regionID]
+	if cacheEntry.refresh {
+		runAgain = time.Now()
+		lastModified = time.Time{}
+	}
 	cacheEntry.runAgain = runAgain
 	cacheEntry.lastModified = lastModified
 	regionUpdateSchedule.store[regionID] = cacheEntry
 	regionUpdateSchedule.Unlock()
 }
 
-// Schedules region updates
-func scheduleRegionUpdate() {
+// Schedules region and structure updates
+func scheduleRegionUpdate(ctx context.Context) {
 	ticker := time.NewTicker(time.Minute * 5)
 	defer ticker.Stop()
 	for {
-		<-ticker.C
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
 		go updateRegions()
+		go updateStructures()
 	}
 }
 
@@ -86,39 +185,100 @@ func updateRegions() {
 	regionUpdateSchedule.Unlock()
 }
 
-// Schedules market updates
-func scheduleMarketUpdate() {
+// Schedules market updates while this instance is leader and took over
+func scheduleMarketUpdate(ctx context.Context, elected <-chan struct{}) {
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 	for {
-		<-ticker.C
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-elected:
+			elected = leader.Elected()
+			go takeOver(ctx, leader.Term())
+			continue
+		}
+
+		if !isReady() {
+			continue
+		}
+
 		go updateMarkets()
+		go updateStructureMarkets()
 	}
 }
 
-// Updates markets
+// Queues due markets, the worker pool dispatches regions with higher priority first
 func updateMarkets() {
+	if atomic.LoadInt32(&paused) == 1 {
+		return
+	}
+
 	regionUpdateSchedule.Lock()
 	for regionID, entry := range regionUpdateSchedule.store {
-		if entry.runAgain.Before(time.Now()) {
-			// Update again in 10 minutes if not re-scheduled by itself
+		if entry.runAgain.Before(time.Now()) && !entry.paused {
+			due := entry.runAgain
+
+			// Update again in 10 minutes if not re-scheduled by itself (e.g. on panic)
 			entry.runAgain = time.Now().Add(time.Second * 600)
-			regionUpdateSchedule.store[regionID] = entry
 
-			go func(regionID int64, lastModified time.Time) {
-				payload, runAgain, newLastModified, err := scraper.ScrapeMarket(regionID, lastModified)
-				if err != nil {
-					logrus.WithError(err).Error("Failed to scrape market.")
-					return
-				}
-
-				if payload != nil {
-					// Payload could be nil when there was no modifiaction of the market
-					upstream <- payload
-				}
-				ScheduleRegion(regionID, *runAgain, *newLastModified)
-			}(regionID, entry.lastModified)
+			regionID := regionID
+			lastModified := entry.lastModified
+			queued := enqueue(&scrapeJob{
+				key:          fmt.Sprintf("region:%d", regionID),
+				priority:     entry.priority,
+				highPriority: highPriorityRegions[regionID],
+				due:          due,
+				run: func() {
+					updateMarket(regionID, lastModified)
+				},
+			})
+
+			// A refresh requested while the region is still queued or running is kept for the next run
+			if queued {
+				entry.refresh = false
+			}
+			regionUpdateSchedule.store[regionID] = entry
 		}
 	}
 	regionUpdateSchedule.Unlock()
 }
+
+// Scrape a region's market and publish the resulting messages
+func updateMarket(regionID int64, lastModified time.Time) {
+	term := leader.Term()
+	start := time.Now()
+
+	// Hung scrapes are cancelled and retried according to the retry policy
+	ctx, cancel := context.WithTimeout(scrapeContext, scrapeTimeout)
+	defer cancel()
+
+	messages, runAgain, newLastModified, err := scraper.ScrapeMarket(ctx, regionID, lastModified)
+	recordRun(regionID, start, messages)
+	if err != nil {
+		recordFailure(regionID, err)
+		return
+	}
+
+	// There are no messages when there was no modifiaction of the market
+	for _, message := range messages {
+		message.Term = term
+		upstream <- message
+	}
+	ScheduleRegion(regionID, *runAgain, *newLastModified)
+	recordSuccess(regionID)
+}
+
+// Keep a run's time, duration and number of orders (if the market was modified) for the admin API
+func recordRun(regionID int64, start time.Time, messages []*emdr.Message) {
+	regionUpdateSchedule.Lock()
+	entry := regionUpdateSchedule.store[regionID]
+	entry.lastRun = start
+	entry.lastDuration = time.Since(start)
+	if len(messages) > 0 {
+		entry.numOrders = messages[0].NumOrders
+	}
+	regionUpdateSchedule.store[regionID] = entry
+	regionUpdateSchedule.Unlock()
+}
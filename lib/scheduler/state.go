@@ -0,0 +1,176 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/EVE-Tools/market-streamer/lib/locations/citadels"
+	"github.com/sirupsen/logrus"
+)
+
+// State is saved with this period
+const stateSaveInterval = 30 * time.Second
+
+// Path of the state file, empty if disabled
+var statePath string
+
+// Scheduler's state as persisted on disk
+type persistedState struct {
+	Regions    map[int64]persistedEntry `json:"regions"`
+	Structures map[int64]persistedEntry `json:"structures"`
+}
+
+type persistedEntry struct {
+	RunAgain     time.Time `json:"runAgain"`
+	LastModified time.Time `json:"lastModified"`
+	Failures     int       `json:"failures"`
+	Paused       bool      `json:"paused,omitempty"`
+	Priority     int       `json:"priority,omitempty"`
+}
+
+// Restore schedule from the state file, so that unchanged markets are not published again after a restart
+func restoreState() {
+	if statePath == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return
+	}
+
+	if err != nil {
+		logrus.WithError(err).Warn("Could not read scheduler state!")
+		return
+	}
+
+	var state persistedState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		logrus.WithError(err).Warn("Could not parse scheduler state!")
+		return
+	}
+
+	regionUpdateSchedule.Lock()
+	for regionID, persisted := range state.Regions {
+		entry, ok := regionUpdateSchedule.store[regionID]
+		if !ok {
+			continue
+		}
+
+		// Overdue regions keep their random offset as on a fresh start
+		if persisted.RunAgain.After(time.Now()) {
+			entry.runAgain = persisted.RunAgain
+		}
+		entry.lastModified = persisted.LastModified
+		entry.failures = persisted.Failures
+		entry.paused = persisted.Paused
+		entry.priority = persisted.Priority
+		regionUpdateSchedule.store[regionID] = entry
+
+		setRegionFailures(regionID, entry.failures)
+	}
+	regionUpdateSchedule.Unlock()
+
+	// Structure markets are not persisted and have to be fetched again, only keep backoff of failing structures
+	structureUpdateSchedule.Lock()
+	for structureID, persisted := range state.Structures {
+		entry, ok := structureUpdateSchedule.store[structureID]
+		if !ok || persisted.Failures == 0 || !persisted.RunAgain.After(time.Now()) {
+			continue
+		}
+
+		entry.runAgain = persisted.RunAgain
+		entry.failures = persisted.Failures
+		structureUpdateSchedule.store[structureID] = entry
+
+		citadels.RestoreBackoff(structureID, persisted.Failures, persisted.RunAgain)
+	}
+	structureUpdateSchedule.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"numRegions":    len(state.Regions),
+		"numStructures": len(state.Structures),
+	}).Info("Restored scheduler state.")
+}
+
+// Schedules saving the state
+func scheduleStateSave(ctx context.Context) {
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		// Standby instances must not overwrite the leader's state, nor may a leader which did not restore it yet
+		if !isReady() {
+			continue
+		}
+
+		err := saveState()
+		if err != nil {
+			logrus.WithError(err).Warn("Could not save scheduler state!")
+		}
+	}
+}
+
+// Atomically write the current schedule to the state file
+func saveState() error {
+	state := persistedState{
+		Regions:    make(map[int64]persistedEntry),
+		Structures: make(map[int64]persistedEntry),
+	}
+
+	regionUpdateSchedule.RLock()
+	for regionID, entry := range regionUpdateSchedule.store {
+		state.Regions[regionID] = newPersistedEntry(entry)
+	}
+	regionUpdateSchedule.RUnlock()
+
+	structureUpdateSchedule.RLock()
+	for structureID, entry := range structureUpdateSchedule.store {
+		state.Structures[structureID] = newPersistedEntry(entry)
+	}
+	structureUpdateSchedule.RUnlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(statePath), filepath.Base(statePath)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), statePath)
+}
+
+func newPersistedEntry(entry scheduleEntry) persistedEntry {
+	return persistedEntry{
+		RunAgain:     entry.runAgain,
+		LastModified: entry.lastModified,
+		Failures:     entry.failures,
+		Paused:       entry.paused,
+		Priority:     entry.priority,
+	}
+}
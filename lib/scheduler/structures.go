@@ -0,0 +1,140 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/EVE-Tools/market-streamer/lib/locations/citadels"
+	"github.com/EVE-Tools/market-streamer/lib/locations/regions"
+	"github.com/EVE-Tools/market-streamer/lib/scraper"
+	"github.com/sirupsen/logrus"
+)
+
+// structureID -> Update time, last modified time
+var structureUpdateSchedule = struct {
+	sync.RWMutex
+	store map[int64]scheduleEntry
+}{store: make(map[int64]scheduleEntry)}
+
+// ScheduleStructure schedules the structureID for update at a specific time
+func ScheduleStructure(structureID int64, runAgain time.Time, lastModified time.Time) {
+	structureUpdateSchedule.Lock()
+	cacheEntry := structureUpdateSchedule.store[structureID]
+	cacheEntry.runAgain = runAgain
+	cacheEntry.lastModified = lastModified
+	structureUpdateSchedule.store[structureID] = cacheEntry
+	structureUpdateSchedule.Unlock()
+}
+
+// Updates structures from the citadels in all market regions
+func updateStructures() {
+	structureIDs := citadels.GetCitadelsInRegions(regions.GetMarketRegions())
+
+	structureUpdateSchedule.Lock()
+	oldMap := structureUpdateSchedule.store
+	structureUpdateSchedule.store = make(map[int64]scheduleEntry)
+
+	for _, structureID := range structureIDs {
+		// Transfer structures from old map or add new entries, new structures are spread over a minute
+		// so that they are available before their region's first update
+		if oldEntry, ok := oldMap[structureID]; ok {
+			structureUpdateSchedule.store[structureID] = oldEntry
+			delete(oldMap, structureID)
+		} else {
+			randomOffset := time.Now().Add(time.Second * time.Duration(rand.Intn(60)))
+			structureUpdateSchedule.store[structureID] = scheduleEntry{
+				runAgain:     randomOffset,
+				lastModified: time.Time{},
+			}
+		}
+	}
+	structureUpdateSchedule.Unlock()
+
+	// Do not keep markets of structures which are gone
+	for structureID := range oldMap {
+		scraper.ForgetStructure(structureID)
+	}
+}
+
+// Updates structure markets
+func updateStructureMarkets() {
+	if atomic.LoadInt32(&paused) == 1 {
+		return
+	}
+
+	structureUpdateSchedule.Lock()
+	for structureID, entry := range structureUpdateSchedule.store {
+		if entry.runAgain.Before(time.Now()) {
+			due := entry.runAgain
+
+			// Update again in 10 minutes if not re-scheduled by itself (e.g. on panic)
+			entry.runAgain = time.Now().Add(time.Second * 600)
+			structureUpdateSchedule.store[structureID] = entry
+
+			structureID := structureID
+			enqueue(&scrapeJob{
+				key: fmt.Sprintf("structure:%d", structureID),
+				due: due,
+				run: func() {
+					updateStructureMarket(structureID)
+				},
+			})
+		}
+	}
+	structureUpdateSchedule.Unlock()
+}
+
+// Scrape a structure's market, failing structures are backed off
+func updateStructureMarket(structureID int64) {
+	ctx, cancel := context.WithTimeout(scrapeContext, scrapeTimeout)
+	defer cancel()
+
+	runAgain, lastModified, err := scraper.ScrapeStructure(ctx, structureID)
+	if err != nil {
+		// Back off, forbidden markets (e.g. if we don't have access) for a long time
+		esiErr, ok := err.(*scraper.ESIError)
+		forbidden := ok && esiErr.StatusCode == 403
+		retryAt := citadels.ReportFailure(structureID, forbidden)
+		setStructureFailure(structureID, retryAt)
+
+		logger := logrus.WithError(err).WithFields(logrus.Fields{
+			"structureID": structureID,
+			"retryAt":     retryAt,
+		})
+
+		if forbidden {
+			logger.Debug("Structure market forbidden.")
+		} else {
+			logger.Warn("Failed to scrape structure market.")
+		}
+		return
+	}
+
+	citadels.ReportSuccess(structureID)
+	ScheduleStructure(structureID, *runAgain, *lastModified)
+	setStructureSuccess(structureID)
+}
+
+// Re-schedule a failed structure for when its backoff ends, its market has been dropped
+func setStructureFailure(structureID int64, retryAt time.Time) {
+	structureUpdateSchedule.Lock()
+	entry := structureUpdateSchedule.store[structureID]
+	entry.runAgain = retryAt
+	entry.lastModified = time.Time{}
+	entry.failures++
+	structureUpdateSchedule.store[structureID] = entry
+	structureUpdateSchedule.Unlock()
+}
+
+// Reset failures after a successful scrape
+func setStructureSuccess(structureID int64) {
+	structureUpdateSchedule.Lock()
+	entry := structureUpdateSchedule.store[structureID]
+	entry.failures = 0
+	structureUpdateSchedule.store[structureID] = entry
+	structureUpdateSchedule.Unlock()
+}
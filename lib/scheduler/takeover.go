@@ -0,0 +1,95 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/EVE-Tools/market-streamer/lib/leader"
+	"github.com/EVE-Tools/market-streamer/lib/locations/citadels"
+	"github.com/EVE-Tools/market-streamer/lib/locations/regions"
+	"github.com/EVE-Tools/market-streamer/lib/marketTypes"
+	"github.com/sirupsen/logrus"
+)
+
+// Delay between attempts to load regions and types when taking over
+const takeOverRetryDelay = time.Minute
+
+// Markets are only scraped once regions, citadels and types were loaded in the current term, otherwise
+// snapshots would lack the empty rowsets of types without orders
+var takeover = struct {
+	sync.Mutex
+	term    uint64
+	started bool
+	done    bool
+}{}
+
+// Load regions, citadels and types, then restore the schedule and start scraping if still leader of term
+func takeOver(ctx context.Context, term uint64) {
+	takeover.Lock()
+	if takeover.started && takeover.term == term {
+		takeover.Unlock()
+		return
+	}
+	takeover.term = term
+	takeover.started = true
+	takeover.done = false
+	takeover.Unlock()
+
+	logrus.WithField("term", term).Info("Taking over, loading regions, citadels and types.")
+
+	for leader.IsCurrent(term) {
+		err := regions.Update()
+		if err != nil {
+			logrus.WithError(err).Error("Could not update market regions!")
+		}
+
+		// Types kept from a previous term are only refreshed if outdated
+		err = marketTypes.Load()
+		if err != nil {
+			logrus.WithError(err).Error("Failed to get market types!")
+		}
+
+		// Lists kept from a previous term are better than not scraping at all
+		if len(regions.GetMarketRegions()) > 0 && len(marketTypes.GetMarketTypes()) > 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(takeOverRetryDelay):
+		}
+	}
+
+	citadels.Update()
+
+	if !leader.IsCurrent(term) {
+		return
+	}
+
+	// Continue where the previous leader left off, if the state file is shared
+	updateRegions()
+	updateStructures()
+	restoreState()
+
+	takeover.Lock()
+	if takeover.term == term {
+		takeover.done = true
+	}
+	takeover.Unlock()
+
+	logrus.WithField("term", term).Info("Took over, scraping markets.")
+}
+
+// Check whether markets may be scraped, i.e. this instance is leader and took over in the current term
+func isReady() bool {
+	term := leader.Term()
+	if !leader.IsCurrent(term) {
+		return false
+	}
+
+	takeover.Lock()
+	defer takeover.Unlock()
+	return takeover.done && takeover.term == term
+}
@@ -0,0 +1,29 @@
+package scheduler
+
+import "testing"
+
+func TestIsReady(t *testing.T) {
+	defer func() {
+		takeover.started = false
+		takeover.done = false
+	}()
+
+	// Without leader election, this instance is leader of term 0
+	takeover.term = 0
+	takeover.started = true
+	takeover.done = false
+	if isReady() {
+		t.Error("ready before regions, citadels and types were loaded")
+	}
+
+	takeover.done = true
+	if !isReady() {
+		t.Error("not ready after taking over")
+	}
+
+	// Taken over in a past term
+	takeover.term = 1
+	if isReady() {
+		t.Error("ready although taken over in another term")
+	}
+}
@@ -0,0 +1,210 @@
+package scraper
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/antihax/goesi"
+	"github.com/sirupsen/logrus"
+)
+
+// Number of pages of a market fetched concurrently
+const pageWorkers = 8
+
+// Number of attempts for getting a market's pages from the same cache generation
+const maxPageAttempts = 3
+
+type page struct {
+	orders   []esiOrder
+	response *http.Response
+}
+
+// Fetches a single page of a market, the request is cancelled once ctx is done
+type pageFetcher func(ctx context.Context, pageNumber int32) (page, error)
+
+// Get a single page of a region's orders
+func getRegionPage(regionID int64) pageFetcher {
+	return func(ctx context.Context, pageNumber int32) (page, error) {
+		params := make(map[string]interface{})
+		params["page"] = pageNumber
+
+		regionOrders, response, err := esiClient.ESI.MarketApi.GetMarketsRegionIdOrders(ctx, "all", int32(regionID), params)
+		if err != nil {
+			return page{}, wrapError(response, err)
+		}
+
+		var orders []esiOrder
+		for _, regionOrder := range regionOrders {
+			orders = append(orders, esiOrder(regionOrder))
+		}
+
+		return page{orders: orders, response: response}, nil
+	}
+}
+
+// Get a single page of a citadel's orders, requests are authenticated with the public token
+func getCitadelPage(citadelID int64) pageFetcher {
+	return func(ctx context.Context, pageNumber int32) (page, error) {
+		ctx = context.WithValue(ctx, goesi.ContextOAuth2, esiPublicToken)
+		params := make(map[string]interface{})
+		params["page"] = pageNumber
+
+		citadelOrders, response, err := esiClient.ESI.MarketApi.GetMarketsStructuresStructureId(ctx, citadelID, params)
+		if err != nil {
+			return page{}, wrapError(response, err)
+		}
+
+		var orders []esiOrder
+		for _, citadelOrder := range citadelOrders {
+			orders = append(orders, esiOrder(citadelOrder))
+		}
+
+		return page{orders: orders, response: response}, nil
+	}
+}
+
+// Get all pages of a market from the same cache generation, if it was modified after lastModified (nil pages
+// otherwise). If the cache kept changing while fetching, the pages of the last attempt are returned as inconsistent.
+func getMarketPages(ctx context.Context, fetch pageFetcher, lastModified time.Time, fields logrus.Fields) (pages []page, runAgain time.Time, newLastModified time.Time, consistent bool, err error) {
+	for attempt := 1; attempt <= maxPageAttempts && !consistent; attempt++ {
+		// First page -> re-schedule, check if modified since last execution
+		firstPage, err := fetch(ctx, 1)
+		if err != nil {
+			return nil, runAgain, newLastModified, false, err
+		}
+
+		runAgain, newLastModified, err = parseCacheHeaders(firstPage.response)
+		if err != nil {
+			return nil, runAgain, newLastModified, false, err
+		}
+
+		if !newLastModified.After(lastModified) {
+			return nil, runAgain, newLastModified, false, nil
+		}
+
+		pages, err = getRemainingPages(ctx, firstPage, fetch)
+		if err != nil {
+			return nil, runAgain, newLastModified, false, err
+		}
+
+		// Never mix two cache generations in one snapshot, refetch if the cache changed meanwhile
+		consistent = pagesConsistent(pages)
+		if !consistent {
+			logrus.WithFields(fields).WithField("attempt", attempt).Warn("Market's cache changed while fetching pages.")
+		}
+	}
+
+	return pages, runAgain, newLastModified, consistent, nil
+}
+
+// Get all remaining pages announced by the first page's X-Pages header concurrently. The first
+// failure cancels all other requests, as the market is incomplete anyway.
+func getRemainingPages(ctx context.Context, firstPage page, fetch pageFetcher) ([]page, error) {
+	numPages, err := strconv.Atoi(firstPage.response.Header.Get("x-pages"))
+	if err != nil {
+		logrus.WithError(err).Warn("Could not parse ESI X-Pages header, assuming single page!")
+		numPages = 1
+	}
+
+	// Empty markets may report zero pages, but still returned the first one
+	if numPages < 1 {
+		numPages = 1
+	}
+
+	pages := make([]page, numPages)
+	pages[0] = firstPage
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pageNumbers := make(chan int32)
+	var firstFailure error
+	var failureOnce sync.Once
+	var wg sync.WaitGroup
+
+	for worker := 0; worker < pageWorkers && worker < numPages-1; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pageNumber := range pageNumbers {
+				fetchedPage, err := fetch(ctx, pageNumber)
+				if err != nil {
+					// Later failures are mostly caused by cancelling
+					failureOnce.Do(func() {
+						firstFailure = err
+						cancel()
+					})
+					continue
+				}
+
+				pages[pageNumber-1] = fetchedPage
+			}
+		}()
+	}
+
+dispatch:
+	for pageNumber := int32(2); pageNumber <= int32(numPages); pageNumber++ {
+		select {
+		case pageNumbers <- pageNumber:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(pageNumbers)
+
+	wg.Wait()
+
+	if firstFailure != nil {
+		return nil, firstFailure
+	}
+
+	// Pages may be missing if the scrape was cancelled meanwhile
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return pages, nil
+}
+
+// Check if all pages belong to the same cache generation, i.e. share last-modified and expires
+func pagesConsistent(pages []page) bool {
+	for _, page := range pages[1:] {
+		if page.response.Header.Get("last-modified") != pages[0].response.Header.Get("last-modified") ||
+			page.response.Header.Get("expires") != pages[0].response.Header.Get("expires") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Get when to fetch a market again and when it was last modified from a response's cache headers
+func parseCacheHeaders(response *http.Response) (runAgain time.Time, lastModified time.Time, err error) {
+	expiry, err := time.Parse(time.RFC1123, response.Header.Get("expires"))
+	if err != nil {
+		// Will run in 10 minutes, anyway
+		logrus.WithError(err).Warn("Could not parse ESI expires timestamp!")
+		return runAgain, lastModified, err
+	}
+
+	// If expired in the past check back in fifteen seconds (see next line) as the CDN might take some time to refresh
+	if expiry.Before(time.Now()) {
+		expiry = time.Now().Add(time.Second * 10)
+	}
+
+	// Re-schedule self with 5 second safety margin
+	runAgain = expiry.Add(time.Second * 5)
+
+	// Check if we really got a new market or the cached version from last time
+	lastModified, err = time.Parse(time.RFC1123, response.Header.Get("last-modified"))
+	if err != nil {
+		// Will run in 10 minutes, anyway
+		logrus.WithError(err).Warn("Could not parse ESI last-modified timestamp!")
+		return runAgain, lastModified, err
+	}
+
+	return runAgain, lastModified, nil
+}
@@ -0,0 +1,116 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func pageWithHeaders(numPages string) page {
+	response := &http.Response{Header: make(http.Header)}
+	response.Header.Set("x-pages", numPages)
+	response.Header.Set("last-modified", "Thu, 01 Jun 2017 12:30:00 GMT")
+	response.Header.Set("expires", "Thu, 01 Jun 2017 12:35:00 GMT")
+
+	return page{response: response}
+}
+
+func TestGetRemainingPages(t *testing.T) {
+	tests := []struct {
+		numPages string
+		want     int
+	}{
+		{"1", 1},
+		{"0", 1},
+		{"-3", 1},
+		{"", 1},
+		{"5", 5},
+		{"100", 100},
+	}
+
+	for _, test := range tests {
+		var requests int32
+		fetch := func(ctx context.Context, pageNumber int32) (page, error) {
+			atomic.AddInt32(&requests, 1)
+			return pageWithHeaders(test.numPages), nil
+		}
+
+		pages, err := getRemainingPages(context.Background(), pageWithHeaders(test.numPages), fetch)
+		if err != nil {
+			t.Fatalf("X-Pages %q: %v", test.numPages, err)
+		}
+
+		if len(pages) != test.want || int(requests) != test.want-1 {
+			t.Errorf("X-Pages %q: got %d pages with %d requests, want %d", test.numPages, len(pages), requests, test.want)
+		}
+
+		for i, page := range pages {
+			if page.response == nil {
+				t.Errorf("X-Pages %q: page %d missing", test.numPages, i+1)
+			}
+		}
+	}
+}
+
+func TestGetRemainingPagesFailure(t *testing.T) {
+	failure := errors.New("ESI error")
+	var requests int32
+
+	fetch := func(ctx context.Context, pageNumber int32) (page, error) {
+		atomic.AddInt32(&requests, 1)
+		if pageNumber == 2 {
+			return page{}, failure
+		}
+
+		// Other requests only finish when cancelled
+		select {
+		case <-ctx.Done():
+			return page{}, ctx.Err()
+		case <-time.After(10 * time.Second):
+			return pageWithHeaders("1000"), nil
+		}
+	}
+
+	pages, err := getRemainingPages(context.Background(), pageWithHeaders("1000"), fetch)
+	if err != failure {
+		t.Errorf("got error %v, want %v", err, failure)
+	}
+
+	if pages != nil {
+		t.Errorf("got %d pages despite failure", len(pages))
+	}
+
+	if requests > 2*pageWorkers {
+		t.Errorf("got %d requests after failure", requests)
+	}
+}
+
+func TestGetRemainingPagesCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	fetch := func(ctx context.Context, pageNumber int32) (page, error) {
+		return pageWithHeaders("3"), nil
+	}
+
+	_, err := getRemainingPages(ctx, pageWithHeaders("3"), fetch)
+	if err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestPagesConsistent(t *testing.T) {
+	changed := pageWithHeaders("3")
+	changed.response.Header.Set("last-modified", "Thu, 01 Jun 2017 12:35:00 GMT")
+
+	if !pagesConsistent([]page{pageWithHeaders("3"), pageWithHeaders("3"), pageWithHeaders("3")}) {
+		t.Error("pages of same generation reported inconsistent")
+	}
+
+	if pagesConsistent([]page{pageWithHeaders("3"), changed, pageWithHeaders("3")}) {
+		t.Error("pages of different generations reported consistent")
+	}
+}
@@ -1,7 +1,6 @@
 package scraper
 
 import (
-	"bytes"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,12 +10,16 @@ import (
 	"golang.org/x/oauth2"
 
 	"github.com/EVE-Tools/emdr-to-nsq/lib/emds"
+	"github.com/EVE-Tools/market-streamer/lib/compression"
+	"github.com/EVE-Tools/market-streamer/lib/delta"
+	"github.com/EVE-Tools/market-streamer/lib/emdr"
 	"github.com/EVE-Tools/market-streamer/lib/locations/citadels"
 	"github.com/EVE-Tools/market-streamer/lib/locations/locationCache"
 	"github.com/EVE-Tools/market-streamer/lib/marketTypes"
+	"github.com/EVE-Tools/market-streamer/lib/orderTracker"
+	"github.com/EVE-Tools/market-streamer/lib/serialization"
 	"github.com/antihax/goesi"
 	"github.com/antihax/goesi/esi"
-	"github.com/klauspost/compress/zlib"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 )
@@ -24,10 +27,12 @@ import (
 type esiOrder esi.GetMarketsRegionIdOrders200Ok
 
 var esiClient *goesi.APIClient
-var esiPublicContext context.Context
+var esiPublicToken oauth2.TokenSource
+var format serialization.Format
+var codec compression.Codec
 
 // Initialize initializes the scraper
-func Initialize(clientID string, secretKey string, refreshToken string, httpClient *http.Client, client *goesi.APIClient) {
+func Initialize(clientID string, secretKey string, refreshToken string, httpClient *http.Client, client *goesi.APIClient, payloadFormat serialization.Format, payloadCodec compression.Codec) {
 	// Requests to citadel's markets are authenticated - we're just using a default key for retrieving public markets
 	esiAuthenticator := goesi.NewSSOAuthenticator(
 		httpClient,
@@ -46,56 +51,31 @@ func Initialize(clientID string, secretKey string, refreshToken string, httpClie
 		Expiry:       time.Now().AddDate(0, 0, -1),
 	}
 
-	esiPublicToken, err := esiAuthenticator.TokenSource(token)
+	publicToken, err := esiAuthenticator.TokenSource(token)
 	if err != nil {
 		log.Fatalf("Error starting bootstrap ESI client: %v", err)
 	}
 
-	esiPublicContext = context.WithValue(context.TODO(), goesi.ContextOAuth2, esiPublicToken)
+	esiPublicToken = publicToken
 	esiClient = client
+	format = payloadFormat
+	codec = payloadCodec
 }
 
-// ScrapeMarket gets a market from ESI and pushes it to supported backends
-func ScrapeMarket(regionID int64, lastModified time.Time) ([]byte, *time.Time, *time.Time, error) {
+// ScrapeMarket gets a market from ESI and pushes it to supported backends, all requests are cancelled once ctx is done
+func ScrapeMarket(ctx context.Context, regionID int64, lastModified time.Time) ([]*emdr.Message, *time.Time, *time.Time, error) {
 	// Prepare empty rowsets with all market types
 	rowsets := generateRowsetsForRegion(regionID)
 
 	//
 	// Fetch public region Orders
 	//
-	// // First page -> re-schedule, check if modified since last execution
-	params := make(map[string]interface{})
-	params["page"] = int32(1)
-
-	esiOrdersRegion, response, err := esiClient.ESI.MarketApi.GetMarketsRegionIdOrders(nil, "all", int32(regionID), params)
-	if err != nil {
-		return nil, nil, nil, err
-	}
-
-	expiry, err := time.Parse(time.RFC1123, response.Header.Get("expires"))
-	if err != nil {
-		// Will run in 10 minutes, anyway
-		logrus.WithError(err).Warn("Could not parse ESI expires timestamp!")
-		return nil, nil, nil, err
-	}
-
-	// If expired in the past check back in fifteen seconds (see next line) as the CDN might take some time to refresh
-	if expiry.Before(time.Now()) {
-		expiry = time.Now().Add(time.Second * 10)
-	}
-
-	// Re-schedule self with 5 second safety margin
-	runAgain := expiry.Add(time.Second * 5)
-
-	// Check if we really got a new market or the cached version from last time
-	newLastModified, err := time.Parse(time.RFC1123, response.Header.Get("last-modified"))
+	pages, runAgain, newLastModified, consistent, err := getMarketPages(ctx, getRegionPage(regionID), lastModified, logrus.Fields{"regionID": regionID})
 	if err != nil {
-		// Will run in 10 minutes, anyway
-		logrus.WithError(err).Warn("Could not parse ESI last-modified timestamp!")
 		return nil, nil, nil, err
 	}
 
-	if !newLastModified.After(lastModified) {
+	if pages == nil {
 		// We got an old market, stop here
 		logrus.WithFields(logrus.Fields{
 			"regionID": regionID,
@@ -106,63 +86,43 @@ func ScrapeMarket(regionID int64, lastModified time.Time) ([]byte, *time.Time, *
 	}
 
 	// Add orders to rowset
-	err = appendResponseRegion(rowsets, esiOrdersRegion, response)
-	if err != nil {
-		return nil, nil, nil, err
-	}
-
-	// Fetch all other pages
-	for len(esiOrdersRegion) > 0 {
-		params["page"] = params["page"].(int32) + 1
-		esiOrdersRegion, response, err = esiClient.ESI.MarketApi.GetMarketsRegionIdOrders(nil, "all", int32(regionID), params)
-		if err != nil {
-			return nil, nil, nil, err
-		}
-
-		// Add orders to rowset
-		err = appendResponseRegion(rowsets, esiOrdersRegion, response)
+	for _, page := range pages {
+		err := appendResponse(ctx, rowsets, page.orders, page.response)
 		if err != nil {
 			return nil, nil, nil, err
 		}
 	}
 
 	//
-	// Fetch orders in citadels
+	// Add latest orders in citadels, which are scraped on their own schedule
 	//
-	citadelIDs := citadels.GetCitadelsInRegion(regionID)
-
-	for _, citadelID := range citadelIDs {
-		params["page"] = int32(1)
-		esiOrdersCitadel, response, err := esiClient.ESI.MarketApi.GetMarketsStructuresStructureId(esiPublicContext, citadelID, params)
-		if err != nil {
-			// Blacklist and skip these citadels
-			if (response != nil) && (response.StatusCode == 403) {
-				citadels.BlacklistCitadel(citadelID)
-				continue
-			}
-			return nil, nil, nil, err
+	var unavailableCitadelIDs []int64
+
+	for _, citadelID := range citadels.GetCitadelsInRegion(regionID) {
+		market, ok := getStructureMarket(citadelID)
+		if !ok {
+			// Not fetched yet or failed
+			unavailableCitadelIDs = append(unavailableCitadelIDs, citadelID)
+			continue
 		}
 
-		// Add orders to rowset
-		err = appendResponseCitadel(rowsets, esiOrdersCitadel, response)
+		consistent = consistent && market.consistent
+
+		err := appendOrders(ctx, rowsets, market.orders, market.lastModified.Format(time.RFC3339))
 		if err != nil {
 			return nil, nil, nil, err
 		}
+	}
 
-		// Fetch all other pages
-		for len(esiOrdersCitadel) > 0 {
-			params["page"] = params["page"].(int32) + 1
-			esiOrdersCitadel, response, err = esiClient.ESI.MarketApi.GetMarketsStructuresStructureId(esiPublicContext, citadelID, params)
-			if err != nil {
-				return nil, nil, nil, err
-			}
+	if len(unavailableCitadelIDs) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"regionID":   regionID,
+			"citadelIDs": unavailableCitadelIDs,
+		}).Warn("Citadel markets unavailable, publishing region without them.")
+	}
 
-			// Add orders to rowset
-			err = appendResponseCitadel(rowsets, esiOrdersCitadel, response)
-			if err != nil {
-				return nil, nil, nil, err
-			}
-		}
+	if !consistent {
+		logrus.WithField("regionID", regionID).Warn("Pages were inconsistent after all attempts, marking snapshot as inconsistent.")
 	}
 
 	// Set generatedAt, sort slices within rowsets and deduplicate orders
@@ -201,7 +161,7 @@ func ScrapeMarket(regionID int64, lastModified time.Time) ([]byte, *time.Time, *
 		}
 	}
 
-	// Serialize rowsets
+	// Collect rowsets
 	rowsetSlice := make([]emds.Rowset, len(rowsets))
 	rowsetIndex := 0
 	numOrders := 0
@@ -211,58 +171,163 @@ func ScrapeMarket(regionID int64, lastModified time.Time) ([]byte, *time.Time, *
 		rowsetIndex++
 	}
 
-	rowsetJSON, err := emds.RowsetsToUUDIF(rowsetSlice, "Element43/market-streamer", "0.1")
-	if err != nil {
-		return nil, nil, nil, err
+	// Depending on delta mode, publish full snapshot and/or delta
+	var messages []*emdr.Message
+	regionDelta, publishSnapshot, commitDelta := delta.Update(regionID, newLastModified, rowsetSlice)
+
+	if publishSnapshot {
+		message, err := buildSnapshotMessage(regionID, newLastModified, runAgain, numOrders, rowsetSlice, consistent, unavailableCitadelIDs)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		messages = append(messages, message)
 	}
 
-	var compressedJSONBuffer bytes.Buffer
-	compressionWriter := zlib.NewWriter(&compressedJSONBuffer)
-	_, err = compressionWriter.Write(rowsetJSON)
-	if err != nil {
-		return nil, nil, nil, err
+	if regionDelta != nil {
+		message, err := buildDeltaMessage(regionDelta, runAgain, numOrders, consistent)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		messages = append(messages, message)
+	}
+
+	// Torn snapshots would yield bogus fills, so skip them. Orders of citadels which could not be
+	// fetched are not considered as gone.
+	var orderEvents *orderTracker.Events
+	if consistent {
+		unavailableLocations := make(map[int64]bool)
+		for _, citadelID := range unavailableCitadelIDs {
+			unavailableLocations[citadelID] = true
+		}
+
+		orderEvents = orderTracker.Update(regionID, newLastModified, rowsetSlice, unavailableLocations)
+	}
+
+	if orderEvents != nil {
+		message, err := buildOrderEventsMessage(orderEvents, runAgain, numOrders)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		messages = append(messages, message)
 	}
 
-	err = compressionWriter.Close()
+	// Only deltas of published snapshots are useful to consumers
+	commitDelta()
+
+	return messages, &runAgain, &newLastModified, nil
+}
+
+// Serialize and compress the region's full snapshot
+func buildSnapshotMessage(regionID int64, lastModified time.Time, runAgain time.Time, numOrders int, rowsets []emds.Rowset, consistent bool, failedStructures []int64) (*emdr.Message, error) {
+	serializedRowsets, err := format.Serialize(regionID, rowsets)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
 
-	compressedJSON := compressedJSONBuffer.Bytes()
+	payload, err := codec.Compress(serializedRowsets)
+	if err != nil {
+		return nil, err
+	}
 
 	logrus.WithFields(logrus.Fields{
 		"regionID":          regionID,
 		"numOrders":         numOrders,
-		"bytesUncompressed": len(rowsetJSON),
-		"bytesCompressed":   len(compressedJSON),
+		"bytesUncompressed": len(serializedRowsets),
+		"bytesCompressed":   len(payload),
+		"format":            format.Name(),
+		"codec":             codec.Name(),
 	}).Info("Uploading market.")
 
-	return compressedJSON, &runAgain, &newLastModified, nil
+	message := emdr.Message{
+		Type:             emdr.TypeSnapshot,
+		RegionID:         regionID,
+		LastModified:     lastModified,
+		NextRun:          runAgain,
+		NumOrders:        numOrders,
+		Inconsistent:     !consistent,
+		FailedStructures: failedStructures,
+		Rowsets:          rowsets,
+		Format:           format.Name(),
+		Codec:            codec.Name(),
+		Payload:          payload,
+	}
+
+	return &message, nil
 }
 
-// Type conversion for regions
-func appendResponseRegion(rowsets map[int64]*emds.Rowset, regionOrders []esi.GetMarketsRegionIdOrders200Ok, response *http.Response) error {
-	var orders []esiOrder
+// Serialize and compress the region's changes since the last snapshot
+func buildDeltaMessage(regionDelta *delta.Delta, runAgain time.Time, numOrders int, consistent bool) (*emdr.Message, error) {
+	serializedDelta, err := format.SerializeDelta(regionDelta)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, regionOrder := range regionOrders {
-		orders = append(orders, esiOrder(regionOrder))
+	payload, err := codec.Compress(serializedDelta)
+	if err != nil {
+		return nil, err
 	}
 
-	return appendResponse(rowsets, orders, response)
+	logrus.WithFields(logrus.Fields{
+		"regionID":          regionDelta.RegionID,
+		"numAdded":          len(regionDelta.Added),
+		"numChanged":        len(regionDelta.Changed),
+		"numRemoved":        len(regionDelta.Removed),
+		"bytesUncompressed": len(serializedDelta),
+		"bytesCompressed":   len(payload),
+	}).Info("Uploading market delta.")
+
+	message := emdr.Message{
+		Type:         emdr.TypeDelta,
+		RegionID:     regionDelta.RegionID,
+		LastModified: regionDelta.LastModified,
+		NextRun:      runAgain,
+		NumOrders:    numOrders,
+		Inconsistent: !consistent,
+		Format:       format.Name(),
+		Codec:        codec.Name(),
+		Payload:      payload,
+	}
+
+	return &message, nil
 }
 
-// Type conversion for citadels
-func appendResponseCitadel(rowsets map[int64]*emds.Rowset, citadelOrders []esi.GetMarketsStructuresStructureId200Ok, response *http.Response) error {
-	var orders []esiOrder
+// Serialize and compress the region's order events since the last snapshot
+func buildOrderEventsMessage(orderEvents *orderTracker.Events, runAgain time.Time, numOrders int) (*emdr.Message, error) {
+	serializedEvents, err := format.SerializeOrderEvents(orderEvents)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, citadelOrder := range citadelOrders {
-		orders = append(orders, esiOrder(citadelOrder))
+	payload, err := codec.Compress(serializedEvents)
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"regionID":          orderEvents.RegionID,
+		"numEvents":         len(orderEvents.Events),
+		"bytesUncompressed": len(serializedEvents),
+		"bytesCompressed":   len(payload),
+	}).Info("Uploading order events.")
+
+	message := emdr.Message{
+		Type:         emdr.TypeOrderEvents,
+		RegionID:     orderEvents.RegionID,
+		LastModified: orderEvents.LastModified,
+		NextRun:      runAgain,
+		NumOrders:    numOrders,
+		Format:       format.Name(),
+		Codec:        codec.Name(),
+		Payload:      payload,
 	}
 
-	return appendResponse(rowsets, orders, response)
+	return &message, nil
 }
 
-func appendResponse(rowsets map[int64]*emds.Rowset, esiOrders []esiOrder, response *http.Response) error {
+func appendResponse(ctx context.Context, rowsets map[int64]*emds.Rowset, esiOrders []esiOrder, response *http.Response) error {
 	lastModified, err := time.Parse(time.RFC1123, response.Header.Get("last-modified"))
 	if err != nil {
 		// Default to now
@@ -272,17 +337,17 @@ func appendResponse(rowsets map[int64]*emds.Rowset, esiOrders []esiOrder, respon
 
 	generatedAt := lastModified.Format(time.RFC3339)
 
-	return appendOrders(rowsets, esiOrders, generatedAt)
+	return appendOrders(ctx, rowsets, esiOrders, generatedAt)
 }
 
-func appendOrders(rowsets map[int64]*emds.Rowset, esiOrders []esiOrder, generatedAt string) error {
+func appendOrders(ctx context.Context, rowsets map[int64]*emds.Rowset, esiOrders []esiOrder, generatedAt string) error {
 	// Collect locations
 	var locationIDs []int64
 	for _, order := range esiOrders {
 		locationIDs = append(locationIDs, order.LocationId)
 	}
 
-	locations, err := locationCache.GetLocations(locationIDs)
+	locations, err := locationCache.GetLocations(ctx, locationIDs)
 	if err != nil {
 		return err
 	}
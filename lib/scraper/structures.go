@@ -0,0 +1,76 @@
+package scraper
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// structureID -> latest market, merged into the region's snapshots
+var structureMarkets = struct {
+	sync.RWMutex
+	store map[int64]structureMarket
+}{store: make(map[int64]structureMarket)}
+
+type structureMarket struct {
+	lastModified time.Time
+	consistent   bool
+	orders       []esiOrder
+}
+
+// ScrapeStructure gets a structure's market from ESI and keeps it for its region's next snapshot, all
+// requests are cancelled once ctx is done.
+// Returns when to run again and when the market was last modified. On error the structure's market
+// is dropped, so that stale orders are not published.
+func ScrapeStructure(ctx context.Context, structureID int64) (*time.Time, *time.Time, error) {
+	previous, _ := getStructureMarket(structureID)
+
+	pages, runAgain, newLastModified, consistent, err := getMarketPages(ctx, getCitadelPage(structureID), previous.lastModified, logrus.Fields{"structureID": structureID})
+	if err != nil {
+		ForgetStructure(structureID)
+		return nil, nil, err
+	}
+
+	if pages == nil {
+		// We got an old market, stop here
+		logrus.WithFields(logrus.Fields{
+			"structureID": structureID,
+			"runAgain":    runAgain,
+		}).Debug("Old structure market.")
+
+		return &runAgain, &newLastModified, nil
+	}
+
+	var orders []esiOrder
+	for _, page := range pages {
+		orders = append(orders, page.orders...)
+	}
+
+	structureMarkets.Lock()
+	structureMarkets.store[structureID] = structureMarket{
+		lastModified: newLastModified,
+		consistent:   consistent,
+		orders:       orders,
+	}
+	structureMarkets.Unlock()
+
+	return &runAgain, &newLastModified, nil
+}
+
+// ForgetStructure drops a structure's market, e.g. if it is not public anymore
+func ForgetStructure(structureID int64) {
+	structureMarkets.Lock()
+	delete(structureMarkets.store, structureID)
+	structureMarkets.Unlock()
+}
+
+// Get a structure's latest market, if any
+func getStructureMarket(structureID int64) (structureMarket, bool) {
+	structureMarkets.RLock()
+	market, ok := structureMarkets.store[structureID]
+	structureMarkets.RUnlock()
+
+	return market, ok
+}
@@ -1,6 +1,29 @@
 package scraper
 
-import "time"
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ESIError is a failed ESI request which returned a response
+type ESIError struct {
+	StatusCode int
+	Err        error
+}
+
+func (err *ESIError) Error() string {
+	return fmt.Sprintf("ESI returned status %d: %s", err.StatusCode, err.Err.Error())
+}
+
+// Attach the response's status code to the error, if there was a response
+func wrapError(response *http.Response, err error) error {
+	if response == nil {
+		return err
+	}
+
+	return &ESIError{StatusCode: response.StatusCode, Err: err}
+}
 
 // ESIOrder is an order returned by the ESI API.
 type ESIOrder struct {
@@ -0,0 +1,261 @@
+package serialization
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/EVE-Tools/emdr-to-nsq/lib/emds"
+	"github.com/EVE-Tools/market-streamer/lib/delta"
+	"github.com/EVE-Tools/market-streamer/lib/orderTracker"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Names of supported formats
+const (
+	UUDIF    = "uudif"
+	Protobuf = "protobuf"
+)
+
+const generatorName = "Element43/market-streamer"
+const generatorVersion = "0.1"
+
+// Format serializes a region's rowsets, deltas and order events
+type Format interface {
+	Name() string
+	Serialize(regionID int64, rowsets []emds.Rowset) ([]byte, error)
+	SerializeDelta(regionDelta *delta.Delta) ([]byte, error)
+	SerializeOrderEvents(events *orderTracker.Events) ([]byte, error)
+}
+
+// Values of market.v1.OrderEvent.Type
+var orderEventTypes = map[orderTracker.EventType]int64{
+	orderTracker.Created:           1,
+	orderTracker.Modified:          2,
+	orderTracker.PartiallyFilled:   3,
+	orderTracker.FilledOrCancelled: 4,
+	orderTracker.Expired:           5,
+}
+
+// NewFormat returns the format with the given name
+func NewFormat(name string) (Format, error) {
+	switch name {
+	case UUDIF:
+		return uudifFormat{}, nil
+	case Protobuf:
+		return protobufFormat{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown format: %s", name)
+}
+
+type uudifFormat struct{}
+
+func (format uudifFormat) Name() string {
+	return UUDIF
+}
+
+func (format uudifFormat) Serialize(regionID int64, rowsets []emds.Rowset) ([]byte, error) {
+	return emds.RowsetsToUUDIF(rowsets, generatorName, generatorVersion)
+}
+
+// UUDIF has no notion of deltas, so use plain JSON with UUDIF's order fields
+func (format uudifFormat) SerializeDelta(regionDelta *delta.Delta) ([]byte, error) {
+	return json.Marshal(regionDelta)
+}
+
+func (format uudifFormat) SerializeOrderEvents(events *orderTracker.Events) ([]byte, error) {
+	return json.Marshal(events)
+}
+
+// Encodes market.v1.RegionSnapshot (see proto/market/v1/market.proto) without generated code
+type protobufFormat struct{}
+
+func (format protobufFormat) Name() string {
+	return Protobuf
+}
+
+func (format protobufFormat) Serialize(regionID int64, rowsets []emds.Rowset) ([]byte, error) {
+	// Most orders of a region share the same few generatedAt timestamps
+	timestamps := make(map[string]int64)
+
+	var snapshot []byte
+	snapshot = appendVarintField(snapshot, 1, regionID)
+	snapshot = appendVarintField(snapshot, 2, time.Now().Unix())
+	snapshot = protowire.AppendTag(snapshot, 3, protowire.BytesType)
+	snapshot = protowire.AppendString(snapshot, generatorName)
+	snapshot = protowire.AppendTag(snapshot, 4, protowire.BytesType)
+	snapshot = protowire.AppendString(snapshot, generatorVersion)
+
+	var rowsetBuffer []byte
+	var orderBuffer []byte
+
+	for _, rowset := range rowsets {
+		generatedAt, err := parseTimestamp(timestamps, rowset.GeneratedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		rowsetBuffer = rowsetBuffer[:0]
+		rowsetBuffer = appendVarintField(rowsetBuffer, 1, rowset.RegionID)
+		rowsetBuffer = appendVarintField(rowsetBuffer, 2, rowset.TypeID)
+		rowsetBuffer = appendVarintField(rowsetBuffer, 3, generatedAt)
+
+		for _, order := range rowset.Rows {
+			orderBuffer, err = appendOrder(orderBuffer[:0], timestamps, order)
+			if err != nil {
+				return nil, err
+			}
+
+			rowsetBuffer = protowire.AppendTag(rowsetBuffer, 4, protowire.BytesType)
+			rowsetBuffer = protowire.AppendBytes(rowsetBuffer, orderBuffer)
+		}
+
+		snapshot = protowire.AppendTag(snapshot, 5, protowire.BytesType)
+		snapshot = protowire.AppendBytes(snapshot, rowsetBuffer)
+	}
+
+	return snapshot, nil
+}
+
+// Encodes market.v1.RegionDelta
+func (format protobufFormat) SerializeDelta(regionDelta *delta.Delta) ([]byte, error) {
+	timestamps := make(map[string]int64)
+
+	var buffer []byte
+	buffer = appendVarintField(buffer, 1, regionDelta.RegionID)
+	buffer = appendVarintField(buffer, 2, regionDelta.LastModified.Unix())
+	buffer = appendVarintField(buffer, 3, regionDelta.BaseLastModified.Unix())
+
+	var err error
+	var orderBuffer []byte
+	fields := []struct {
+		number protowire.Number
+		orders []emds.Order
+	}{
+		{4, regionDelta.Added},
+		{5, regionDelta.Changed},
+		{6, regionDelta.Removed},
+	}
+
+	for _, field := range fields {
+		for _, order := range field.orders {
+			orderBuffer, err = appendOrder(orderBuffer[:0], timestamps, order)
+			if err != nil {
+				return nil, err
+			}
+
+			buffer = protowire.AppendTag(buffer, field.number, protowire.BytesType)
+			buffer = protowire.AppendBytes(buffer, orderBuffer)
+		}
+	}
+
+	return buffer, nil
+}
+
+// Encodes market.v1.OrderEvents
+func (format protobufFormat) SerializeOrderEvents(events *orderTracker.Events) ([]byte, error) {
+	var buffer []byte
+	buffer = appendVarintField(buffer, 1, events.RegionID)
+	buffer = appendVarintField(buffer, 2, events.LastModified.Unix())
+	buffer = appendVarintField(buffer, 3, events.BaseLastModified.Unix())
+
+	var eventBuffer []byte
+	for _, event := range events.Events {
+		eventBuffer = eventBuffer[:0]
+		eventBuffer = appendVarintField(eventBuffer, 1, orderEventTypes[event.Type])
+		eventBuffer = appendVarintField(eventBuffer, 2, event.OrderID)
+		eventBuffer = appendVarintField(eventBuffer, 3, event.TypeID)
+		if event.Bid {
+			eventBuffer = appendVarintField(eventBuffer, 4, 1)
+		}
+		eventBuffer = appendDoubleField(eventBuffer, 5, event.Price)
+		eventBuffer = appendDoubleField(eventBuffer, 6, event.PreviousPrice)
+		eventBuffer = appendVarintField(eventBuffer, 7, event.Volume)
+		eventBuffer = appendVarintField(eventBuffer, 8, event.StationID)
+
+		buffer = protowire.AppendTag(buffer, 4, protowire.BytesType)
+		buffer = protowire.AppendBytes(buffer, eventBuffer)
+	}
+
+	var volumeBuffer []byte
+	for _, volume := range events.Volumes {
+		volumeBuffer = volumeBuffer[:0]
+		volumeBuffer = appendVarintField(volumeBuffer, 1, volume.TypeID)
+		volumeBuffer = appendVarintField(volumeBuffer, 2, volume.Traded)
+		volumeBuffer = appendVarintField(volumeBuffer, 3, volume.Closed)
+
+		buffer = protowire.AppendTag(buffer, 5, protowire.BytesType)
+		buffer = protowire.AppendBytes(buffer, volumeBuffer)
+	}
+
+	return buffer, nil
+}
+
+// Encodes market.v1.Order
+func appendOrder(buffer []byte, timestamps map[string]int64, order emds.Order) ([]byte, error) {
+	generatedAt, err := parseTimestamp(timestamps, order.GeneratedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	issueDate, err := time.Parse(time.RFC3339, order.IssueDate)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer = appendVarintField(buffer, 1, order.OrderID)
+	buffer = appendVarintField(buffer, 2, order.RegionID)
+	buffer = appendVarintField(buffer, 3, order.TypeID)
+	buffer = appendVarintField(buffer, 4, generatedAt)
+	buffer = appendDoubleField(buffer, 5, order.Price)
+	buffer = appendVarintField(buffer, 6, order.VolRemaining)
+	buffer = appendVarintField(buffer, 7, order.OrderRange)
+	buffer = appendVarintField(buffer, 8, order.VolEntered)
+	buffer = appendVarintField(buffer, 9, order.MinVolume)
+	if order.Bid {
+		buffer = appendVarintField(buffer, 10, 1)
+	}
+	buffer = appendVarintField(buffer, 11, issueDate.Unix())
+	buffer = appendVarintField(buffer, 12, order.Duration)
+	buffer = appendVarintField(buffer, 13, order.StationID)
+	buffer = appendVarintField(buffer, 14, order.SolarSystemID)
+
+	return buffer, nil
+}
+
+// Append int64 field, default values are omitted as in proto3
+func appendVarintField(buffer []byte, number protowire.Number, value int64) []byte {
+	if value == 0 {
+		return buffer
+	}
+
+	buffer = protowire.AppendTag(buffer, number, protowire.VarintType)
+	return protowire.AppendVarint(buffer, uint64(value))
+}
+
+// Append double field, default values are omitted as in proto3
+func appendDoubleField(buffer []byte, number protowire.Number, value float64) []byte {
+	if value == 0 {
+		return buffer
+	}
+
+	buffer = protowire.AppendTag(buffer, number, protowire.Fixed64Type)
+	return protowire.AppendFixed64(buffer, math.Float64bits(value))
+}
+
+// Parse RFC3339 timestamp to unix time, using the cache for already seen values
+func parseTimestamp(cache map[string]int64, timestamp string) (int64, error) {
+	if unix, ok := cache[timestamp]; ok {
+		return unix, nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return 0, err
+	}
+
+	cache[timestamp] = parsed.Unix()
+	return parsed.Unix(), nil
+}
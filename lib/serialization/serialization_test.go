@@ -0,0 +1,301 @@
+package serialization
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/EVE-Tools/emdr-to-nsq/lib/emds"
+	"github.com/EVE-Tools/market-streamer/lib/delta"
+	"github.com/EVE-Tools/market-streamer/lib/orderTracker"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type field struct {
+	varint  uint64
+	fixed64 uint64
+	bytes   []byte
+}
+
+// Decode a message's fields by number without knowing its schema
+func decode(t *testing.T, data []byte) map[protowire.Number][]field {
+	t.Helper()
+
+	fields := make(map[protowire.Number][]field)
+	for len(data) > 0 {
+		number, wireType, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		var value field
+		switch wireType {
+		case protowire.VarintType:
+			value.varint, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed64Type:
+			value.fixed64, n = protowire.ConsumeFixed64(data)
+		case protowire.BytesType:
+			value.bytes, n = protowire.ConsumeBytes(data)
+		default:
+			t.Fatalf("unexpected wire type %d of field %d", wireType, number)
+		}
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		fields[number] = append(fields[number], value)
+	}
+
+	return fields
+}
+
+func expectVarint(t *testing.T, fields map[protowire.Number][]field, number protowire.Number, want int64) {
+	t.Helper()
+
+	if want == 0 {
+		if len(fields[number]) != 0 {
+			t.Errorf("field %d: default value was not omitted", number)
+		}
+		return
+	}
+
+	if len(fields[number]) != 1 || int64(fields[number][0].varint) != want {
+		t.Errorf("field %d: got %v, want %d", number, fields[number], want)
+	}
+}
+
+func expectDouble(t *testing.T, fields map[protowire.Number][]field, number protowire.Number, want float64) {
+	t.Helper()
+
+	if len(fields[number]) != 1 || math.Float64frombits(fields[number][0].fixed64) != want {
+		t.Errorf("field %d: got %v, want %f", number, fields[number], want)
+	}
+}
+
+var testOrders = []emds.Order{
+	{
+		OrderID:       4891760001,
+		RegionID:      10000002,
+		TypeID:        34,
+		GeneratedAt:   "2017-06-01T12:30:00+00:00",
+		Price:         4.51,
+		VolRemaining:  1000000,
+		OrderRange:    32767,
+		VolEntered:    2500000,
+		MinVolume:     1,
+		Bid:           true,
+		IssueDate:     "2017-05-30T08:00:00+00:00",
+		Duration:      90,
+		StationID:     60003760,
+		SolarSystemID: 30000142,
+	},
+	{
+		OrderID:       4891760002,
+		RegionID:      10000002,
+		TypeID:        34,
+		GeneratedAt:   "2017-06-01T12:30:00+00:00",
+		Price:         5.02,
+		VolRemaining:  15,
+		VolEntered:    15,
+		MinVolume:     1,
+		IssueDate:     "2017-06-01T11:00:00+00:00",
+		Duration:      30,
+		StationID:     1022734985679,
+		SolarSystemID: 30000142,
+	},
+}
+
+func TestProtobufSerialize(t *testing.T) {
+	rowsets := []emds.Rowset{
+		{GeneratedAt: "2017-06-01T12:30:00+00:00", RegionID: 10000002, TypeID: 34, Rows: testOrders},
+		{GeneratedAt: "2017-06-01T12:30:00+00:00", RegionID: 10000002, TypeID: 35},
+	}
+
+	payload, err := protobufFormat{}.Serialize(10000002, rowsets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := decode(t, payload)
+	expectVarint(t, snapshot, 1, 10000002)
+
+	if len(snapshot[2]) != 1 || time.Since(time.Unix(int64(snapshot[2][0].varint), 0)) > time.Minute {
+		t.Errorf("got generation time %v, want now", snapshot[2])
+	}
+
+	if len(snapshot[3]) != 1 || string(snapshot[3][0].bytes) != generatorName {
+		t.Errorf("got generator name %v", snapshot[3])
+	}
+
+	if len(snapshot[4]) != 1 || string(snapshot[4][0].bytes) != generatorVersion {
+		t.Errorf("got generator version %v", snapshot[4])
+	}
+
+	if len(snapshot[5]) != len(rowsets) {
+		t.Fatalf("got %d rowsets, want %d", len(snapshot[5]), len(rowsets))
+	}
+
+	generatedAt := time.Date(2017, 6, 1, 12, 30, 0, 0, time.UTC).Unix()
+
+	rowset := decode(t, snapshot[5][0].bytes)
+	expectVarint(t, rowset, 1, 10000002)
+	expectVarint(t, rowset, 2, 34)
+	expectVarint(t, rowset, 3, generatedAt)
+
+	if len(rowset[4]) != len(testOrders) {
+		t.Fatalf("got %d orders, want %d", len(rowset[4]), len(testOrders))
+	}
+
+	for i, want := range testOrders {
+		order := decode(t, rowset[4][i].bytes)
+		issueDate, _ := time.Parse(time.RFC3339, want.IssueDate)
+		bid := int64(0)
+		if want.Bid {
+			bid = 1
+		}
+
+		expectVarint(t, order, 1, want.OrderID)
+		expectVarint(t, order, 2, want.RegionID)
+		expectVarint(t, order, 3, want.TypeID)
+		expectVarint(t, order, 4, generatedAt)
+		expectDouble(t, order, 5, want.Price)
+		expectVarint(t, order, 6, want.VolRemaining)
+		expectVarint(t, order, 7, want.OrderRange)
+		expectVarint(t, order, 8, want.VolEntered)
+		expectVarint(t, order, 9, want.MinVolume)
+		expectVarint(t, order, 10, bid)
+		expectVarint(t, order, 11, issueDate.Unix())
+		expectVarint(t, order, 12, want.Duration)
+		expectVarint(t, order, 13, want.StationID)
+		expectVarint(t, order, 14, want.SolarSystemID)
+	}
+
+	// Empty rowsets are kept so consumers know the type has no orders
+	emptyRowset := decode(t, snapshot[5][1].bytes)
+	expectVarint(t, emptyRowset, 2, 35)
+	if len(emptyRowset[4]) != 0 {
+		t.Errorf("got %d orders in empty rowset", len(emptyRowset[4]))
+	}
+}
+
+func TestProtobufSerializeInvalidTimestamp(t *testing.T) {
+	order := testOrders[0]
+	order.IssueDate = "yesterday"
+
+	_, err := protobufFormat{}.Serialize(10000002, []emds.Rowset{
+		{GeneratedAt: "2017-06-01T12:30:00+00:00", RegionID: 10000002, TypeID: 34, Rows: []emds.Order{order}},
+	})
+	if err == nil {
+		t.Error("expected error for invalid issue date")
+	}
+}
+
+func TestProtobufSerializeDelta(t *testing.T) {
+	lastModified := time.Date(2017, 6, 1, 12, 35, 0, 0, time.UTC)
+	baseLastModified := time.Date(2017, 6, 1, 12, 30, 0, 0, time.UTC)
+
+	payload, err := protobufFormat{}.SerializeDelta(&delta.Delta{
+		RegionID:         10000002,
+		LastModified:     lastModified,
+		BaseLastModified: baseLastModified,
+		Added:            testOrders[:1],
+		Changed:          testOrders[1:],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	regionDelta := decode(t, payload)
+	expectVarint(t, regionDelta, 1, 10000002)
+	expectVarint(t, regionDelta, 2, lastModified.Unix())
+	expectVarint(t, regionDelta, 3, baseLastModified.Unix())
+
+	tests := []struct {
+		number protowire.Number
+		orders []emds.Order
+	}{
+		{4, testOrders[:1]},
+		{5, testOrders[1:]},
+		{6, nil},
+	}
+
+	for _, test := range tests {
+		if len(regionDelta[test.number]) != len(test.orders) {
+			t.Errorf("field %d: got %d orders, want %d", test.number, len(regionDelta[test.number]), len(test.orders))
+			continue
+		}
+
+		for i, want := range test.orders {
+			order := decode(t, regionDelta[test.number][i].bytes)
+			expectVarint(t, order, 1, want.OrderID)
+			expectDouble(t, order, 5, want.Price)
+		}
+	}
+}
+
+func TestProtobufSerializeOrderEvents(t *testing.T) {
+	lastModified := time.Date(2017, 6, 1, 12, 35, 0, 0, time.UTC)
+	baseLastModified := time.Date(2017, 6, 1, 12, 30, 0, 0, time.UTC)
+
+	events := orderTracker.Events{
+		RegionID:         10000002,
+		LastModified:     lastModified,
+		BaseLastModified: baseLastModified,
+		Events: []orderTracker.Event{
+			{Type: orderTracker.Created, OrderID: 1, TypeID: 34, Bid: true, Price: 4.5, Volume: 100, StationID: 60003760},
+			{Type: orderTracker.Modified, OrderID: 2, TypeID: 34, Price: 5, PreviousPrice: 5.5, Volume: 10, StationID: 60003760},
+			{Type: orderTracker.PartiallyFilled, OrderID: 3, TypeID: 35, Price: 9, Volume: 7, StationID: 60003760},
+			{Type: orderTracker.FilledOrCancelled, OrderID: 4, TypeID: 35, Price: 9, Volume: 3, StationID: 60003760},
+			{Type: orderTracker.Expired, OrderID: 5, TypeID: 36, Price: 1, Volume: 1, StationID: 60003760},
+		},
+		Volumes: []orderTracker.TypeVolume{
+			{TypeID: 35, Traded: 7, Closed: 3},
+		},
+	}
+
+	payload, err := protobufFormat{}.SerializeOrderEvents(&events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := decode(t, payload)
+	expectVarint(t, message, 1, 10000002)
+	expectVarint(t, message, 2, lastModified.Unix())
+	expectVarint(t, message, 3, baseLastModified.Unix())
+
+	if len(message[4]) != len(events.Events) {
+		t.Fatalf("got %d events, want %d", len(message[4]), len(events.Events))
+	}
+
+	for i, want := range events.Events {
+		event := decode(t, message[4][i].bytes)
+		bid := int64(0)
+		if want.Bid {
+			bid = 1
+		}
+
+		expectVarint(t, event, 1, int64(i+1))
+		expectVarint(t, event, 2, want.OrderID)
+		expectVarint(t, event, 3, want.TypeID)
+		expectVarint(t, event, 4, bid)
+		expectDouble(t, event, 5, want.Price)
+		if want.PreviousPrice != 0 {
+			expectDouble(t, event, 6, want.PreviousPrice)
+		} else if len(event[6]) != 0 {
+			t.Errorf("event %d: previous price was not omitted", i)
+		}
+		expectVarint(t, event, 7, want.Volume)
+		expectVarint(t, event, 8, want.StationID)
+	}
+
+	if len(message[5]) != 1 {
+		t.Fatalf("got %d volumes, want 1", len(message[5]))
+	}
+
+	volume := decode(t, message[5][0].bytes)
+	expectVarint(t, volume, 1, 35)
+	expectVarint(t, volume, 2, 7)
+	expectVarint(t, volume, 3, 3)
+}
@@ -1,18 +1,30 @@
 package main
 
 import (
+	"context"
+	"expvar"
+	"io/ioutil"
+	"net"
 	"net/http"
-	"runtime"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/EVE-Tools/element43/go/lib/transport"
+	"github.com/EVE-Tools/market-streamer/lib/compression"
+	"github.com/EVE-Tools/market-streamer/lib/delta"
 	"github.com/EVE-Tools/market-streamer/lib/emdr"
+	"github.com/EVE-Tools/market-streamer/lib/governor"
+	"github.com/EVE-Tools/market-streamer/lib/leader"
 	"github.com/EVE-Tools/market-streamer/lib/locations/citadels"
 	"github.com/EVE-Tools/market-streamer/lib/locations/locationCache"
 	"github.com/EVE-Tools/market-streamer/lib/locations/regions"
 	"github.com/EVE-Tools/market-streamer/lib/marketTypes"
+	"github.com/EVE-Tools/market-streamer/lib/orderTracker"
 	"github.com/EVE-Tools/market-streamer/lib/scheduler"
 	"github.com/EVE-Tools/market-streamer/lib/scraper"
+	"github.com/EVE-Tools/market-streamer/lib/serialization"
 	"github.com/antihax/goesi"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/sirupsen/logrus"
@@ -20,18 +32,65 @@ import (
 
 // Config holds the application's configuration info from the environment.
 type Config struct {
-	LogLevel           string `default:"info" envconfig:"log_level"`
-	ClientID           string `required:"true" envconfig:"client_id"`
-	SecretKey          string `required:"true" envconfig:"secret_key"`
-	RefreshToken       string `required:"true" envconfig:"refresh_token"`
-	ZMQBindEndpoint    string `default:"tcp://127.0.0.1:8050" envconfig:"zmq_bind_endpoint"`
-	LocationServiceURL string `default:"https://element-43.com/api/static-data/v1/location/" envconfig:"location_service_url"`
+	LogLevel                string        `default:"info" envconfig:"log_level"`
+	ClientID                string        `required:"true" envconfig:"client_id"`
+	SecretKey               string        `required:"true" envconfig:"secret_key"`
+	RefreshToken            string        `required:"true" envconfig:"refresh_token"`
+	Sinks                   []string      `default:"zmq" envconfig:"sinks"`
+	ZMQBindEndpoints        []string      `default:"tcp://127.0.0.1:8050" envconfig:"zmq_bind_endpoint"`
+	ZMQMode                 string        `default:"emdr" envconfig:"zmq_mode"`
+	ZMQCurveSecretKey       string        `default:"" envconfig:"zmq_curve_secret_key"`
+	ZMQLinger               time.Duration `default:"5s" envconfig:"zmq_linger"`
+	ZMQCurveClientKeys      []string      `default:"" envconfig:"zmq_curve_client_keys"`
+	LocationServiceURL      string        `default:"https://element-43.com/api/static-data/v1/location/" envconfig:"location_service_url"`
+	Format                  string        `default:"uudif" envconfig:"format"`
+	Compression             string        `default:"zlib" envconfig:"compression"`
+	ZstdDictionary          string        `default:"" envconfig:"zstd_dictionary"`
+	DeltaMode               string        `default:"off" envconfig:"delta_mode"`
+	KeyframeInterval        int           `default:"12" envconfig:"keyframe_interval"`
+	OrderEvents             bool          `default:"false" envconfig:"order_events"`
+	HTTPBindEndpoint        string        `default:"127.0.0.1:8051" envconfig:"http_bind_endpoint"`
+	ESIErrorLimitThreshold  int64         `default:"20" envconfig:"esi_error_limit_threshold"`
+	RetryBaseDelay          time.Duration `default:"15s" envconfig:"retry_base_delay"`
+	RetryMaxDelay           time.Duration `default:"5m" envconfig:"retry_max_delay"`
+	RetryUnhealthyThreshold int           `default:"5" envconfig:"retry_unhealthy_threshold"`
+	RetryUnhealthyDelay     time.Duration `default:"10m" envconfig:"retry_unhealthy_delay"`
+	RegionInclude           []string      `default:"" envconfig:"region_include"`
+	RegionExclude           []string      `default:"" envconfig:"region_exclude"`
+	RegionFilterFile        string        `default:"" envconfig:"region_filter_file"`
+	ShardIndex              int           `default:"0" envconfig:"shard_index"`
+	ShardCount              int           `default:"1" envconfig:"shard_count"`
+	LeaderElection          string        `default:"none" envconfig:"leader_election"`
+	LeaderLockFile          string        `default:"/tmp/market-streamer.lock" envconfig:"leader_lock_file"`
+	EtcdEndpoints           []string      `default:"127.0.0.1:2379" envconfig:"etcd_endpoints"`
+	LeaderEtcdPrefix        string        `default:"/market-streamer/leader" envconfig:"leader_etcd_prefix"`
+	LeaderTTL               int           `default:"5" envconfig:"leader_ttl"`
+	ScrapeTimeout           time.Duration `default:"2m" envconfig:"scrape_timeout"`
+	ScrapeConcurrency       int           `default:"8" envconfig:"scrape_concurrency"`
+	HighPriorityRegions     []int64       `default:"10000002,10000043,10000032,10000030,10000042" envconfig:"high_priority_regions"`
+	ShutdownDrainTimeout    time.Duration `default:"10s" envconfig:"shutdown_drain_timeout"`
+	ShutdownFlushTimeout    time.Duration `default:"8s" envconfig:"shutdown_flush_timeout"`
+	AdminToken              string        `default:"" envconfig:"admin_token"`
+	StatePath               string        `default:"" envconfig:"state_path"`
+	NATSURL                 string        `default:"nats://127.0.0.1:4222" envconfig:"nats_url"`
+	NATSSubjectPrefix       string        `default:"market.orders" envconfig:"nats_subject_prefix"`
+	NATSStream              string        `default:"" envconfig:"nats_stream"`
+	NSQDAddresses           []string      `default:"127.0.0.1:4150" envconfig:"nsqd_addresses"`
+	NSQTopic                string        `default:"orders" envconfig:"nsq_topic"`
+	NSQPerType              bool          `default:"false" envconfig:"nsq_per_type"`
 }
 
 // Stores main configuration
 var config Config
 
+// Long-lived connections (e.g. events) are closed if they do not finish within this timeout on shutdown
+const shutdownHTTPTimeout = 3 * time.Second
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "train-dictionary" {
+		trainDictionary(os.Args[2:])
+	}
+
 	const userAgent string = "Element43/market-streamer (element-43.com)"
 	const timeout time.Duration = time.Duration(time.Second * 10)
 
@@ -40,26 +99,110 @@ func main() {
 		Transport: transport.NewTransport(userAgent),
 	}
 
+	// Load config and connect to queues
+	loadConfig()
+
+	// All ESI requests share the same error budget. The governor applies the timeout itself, as requests may be
+	// paused for longer than that.
 	httpClientESI := &http.Client{
-		Timeout:   timeout,
-		Transport: transport.NewESITransport(userAgent, timeout),
+		Transport: governor.NewGovernor(transport.NewESITransport(userAgent, timeout), config.ESIErrorLimitThreshold, timeout),
 	}
 
 	esiClient := goesi.NewAPIClient(httpClientESI, userAgent)
 
-	// Load config and connect to queues
-	loadConfig()
-	emdr := emdr.Initialize(config.ZMQBindEndpoint)
+	initializeDelta()
+	initializeOrderEvents()
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	initializeAdmin(mux)
+	messages := emdr.Initialize(initializeSinks(mux))
 	locationCache.Initialize(config.LocationServiceURL, httpClient)
-	regions.Initialize(esiClient)
+	initializeSharding()
+	leaderBackend := initializeLeaderElection()
+	regions.Initialize(esiClient, config.RegionInclude, config.RegionExclude, config.RegionFilterFile)
 	citadels.Initialize(esiClient)
 	marketTypes.Initialize(esiClient)
-	scheduler.Initialize(emdr)
-	scraper.Initialize(config.ClientID, config.SecretKey, config.RefreshToken, httpClientESI, esiClient)
+
+	// The scraper has to be set up before the scheduler's workers start
+	scraper.Initialize(config.ClientID, config.SecretKey, config.RefreshToken, httpClientESI, esiClient, initializeFormat(), initializeCodec())
+
+	// Scheduling stops on shutdown, requests of scrapes still running after the drain timeout are cancelled
+	schedulerContext, stopScheduler := context.WithCancel(context.Background())
+	scrapeContext, abandonScrapes := context.WithCancel(context.Background())
+
+	scheduler.Initialize(messages, scheduler.Options{
+		Context:       schedulerContext,
+		ScrapeContext: scrapeContext,
+		ScrapeTimeout: config.ScrapeTimeout,
+		RetryPolicy: scheduler.RetryPolicy{
+			BaseDelay:          config.RetryBaseDelay,
+			MaxDelay:           config.RetryMaxDelay,
+			UnhealthyThreshold: config.RetryUnhealthyThreshold,
+			UnhealthyDelay:     config.RetryUnhealthyDelay,
+		},
+		StatePath:           config.StatePath,
+		Concurrency:         config.ScrapeConcurrency,
+		HighPriorityRegions: config.HighPriorityRegions,
+	})
+	server := &http.Server{Addr: config.HTTPBindEndpoint, Handler: mux}
+	go serveHTTP(server)
 	logrus.Debug("Done.")
 
-	// Terminate this goroutine, crash if all other goroutines exited
-	runtime.Goexit()
+	waitForSignal()
+	shutdown(server, stopScheduler, abandonScrapes, leaderBackend)
+}
+
+// Block until SIGTERM or SIGINT, a second signal exits immediately
+func waitForSignal() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	received := <-signals
+	logrus.WithField("signal", received.String()).Info("Shutting down.")
+
+	go func() {
+		<-signals
+		logrus.Fatal("Forced shutdown!")
+	}()
+}
+
+// Stop scheduling, drain in-flight scrapes and publish all queued messages before closing the sinks
+func shutdown(server *http.Server, stopScheduler context.CancelFunc, abandonScrapes context.CancelFunc, leaderBackend leader.Backend) {
+	stopScheduler()
+
+	drainContext, cancelDrain := context.WithTimeout(context.Background(), config.ShutdownDrainTimeout)
+	defer cancelDrain()
+
+	err := scheduler.Shutdown(drainContext)
+	if err != nil {
+		logrus.WithError(err).Warn("Abandoning in-flight scrapes.")
+	}
+	abandonScrapes()
+
+	flushContext, cancelFlush := context.WithTimeout(context.Background(), config.ShutdownFlushTimeout)
+	defer cancelFlush()
+
+	err = emdr.Shutdown(flushContext)
+	if err != nil {
+		logrus.WithError(err).Warn("Could not publish all queued messages.")
+	}
+
+	httpContext, cancelHTTP := context.WithTimeout(context.Background(), shutdownHTTPTimeout)
+	defer cancelHTTP()
+
+	err = server.Shutdown(httpContext)
+	if err != nil {
+		server.Close()
+	}
+
+	if leaderBackend != nil {
+		err = leader.Resign(leaderBackend)
+		if err != nil {
+			logrus.WithError(err).Warn("Could not resign leadership.")
+		}
+	}
+
+	logrus.Info("Shutdown complete.")
 }
 
 // Load configuration from environment and compile regexps
@@ -73,3 +216,201 @@ func loadConfig() {
 	logrus.SetLevel(logLevel)
 	logrus.Debugf("Config: %q", config)
 }
+
+// Configure delta stream
+func initializeDelta() {
+	err := delta.Initialize(config.DeltaMode, config.KeyframeInterval)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not initialize deltas!")
+	}
+
+	if config.DeltaMode != delta.ModeOnly {
+		return
+	}
+
+	// Sinks which only publish snapshots would only get the keyframes
+	carried := false
+	for _, name := range config.Sinks {
+		if publishesUpdates(name) {
+			carried = true
+		} else {
+			logrus.WithField("sink", name).Warn("Sink does not publish deltas, it only receives keyframes.")
+		}
+	}
+
+	if !carried {
+		logrus.Fatal("No sink publishes deltas, use zmq in topic mode, nats, nsq or events with DELTA_MODE only!")
+	}
+}
+
+// Configure order events, they are useless if no sink publishes them
+func initializeOrderEvents() {
+	orderTracker.Initialize(config.OrderEvents)
+
+	if !config.OrderEvents {
+		return
+	}
+
+	carried := false
+	for _, name := range config.Sinks {
+		if publishesUpdates(name) {
+			carried = true
+		} else {
+			logrus.WithField("sink", name).Warn("Sink does not publish order events.")
+		}
+	}
+
+	if !carried {
+		logrus.Fatal("No sink publishes order events, use zmq in topic mode, nats, nsq or events with ORDER_EVENTS!")
+	}
+}
+
+// Check if the sink publishes messages other than snapshots (e.g. deltas)
+func publishesUpdates(name string) bool {
+	switch name {
+	case "zmq":
+		return config.ZMQMode != emdr.ZMQModeEMDR
+	case "websocket":
+		return false
+	}
+
+	return true
+}
+
+// Configure which regions this instance owns
+func initializeSharding() {
+	err := regions.InitializeSharding(config.ShardIndex, config.ShardCount)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not initialize sharding!")
+	}
+}
+
+// Mount the admin API on mux, without a token only if the HTTP server is not reachable by others
+func initializeAdmin(mux *http.ServeMux) {
+	if config.AdminToken == "" && !isLoopback(config.HTTPBindEndpoint) {
+		logrus.WithField("endpoint", config.HTTPBindEndpoint).Warn("Admin API disabled, set ADMIN_TOKEN to serve it on a non-loopback address.")
+		return
+	}
+
+	mux.Handle("/admin/", scheduler.NewAdminHandler(config.AdminToken))
+}
+
+// Check whether a bind endpoint only accepts local connections
+func isLoopback(endpoint string) bool {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Campaign for leadership if enabled, until elected markets are not scraped
+func initializeLeaderElection() leader.Backend {
+	var backend leader.Backend
+
+	switch config.LeaderElection {
+	case "none":
+		return nil
+	case "file":
+		backend = leader.NewFileBackend(config.LeaderLockFile)
+	case "etcd":
+		var err error
+		backend, err = leader.NewEtcdBackend(config.EtcdEndpoints, config.LeaderEtcdPrefix, config.LeaderTTL)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not connect to etcd!")
+		}
+	default:
+		logrus.Fatalf("Unknown leader election backend: %s", config.LeaderElection)
+	}
+
+	leader.Initialize(backend)
+	return backend
+}
+
+// Create format for serializing payloads
+func initializeFormat() serialization.Format {
+	format, err := serialization.NewFormat(config.Format)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not initialize format!")
+	}
+
+	return format
+}
+
+// Create codec for compressing payloads
+func initializeCodec() compression.Codec {
+	var dictionary []byte
+
+	if config.ZstdDictionary != "" {
+		var err error
+		dictionary, err = ioutil.ReadFile(config.ZstdDictionary)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not read zstd dictionary!")
+		}
+	}
+
+	codec, err := compression.NewCodec(config.Compression, dictionary)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not initialize codec!")
+	}
+
+	// Uncompressed protobuf can start like a zlib header, so consumers could not detect the codec
+	if config.Format == serialization.Protobuf && codec.Name() == compression.None {
+		logrus.Fatal("The protobuf format requires compression, set COMPRESSION to zlib, gzip or zstd!")
+	}
+
+	return codec
+}
+
+// Create all sinks enabled in config, HTTP based sinks are mounted on mux
+func initializeSinks(mux *http.ServeMux) []emdr.Sink {
+	var sinks []emdr.Sink
+
+	for _, name := range config.Sinks {
+		var sink emdr.Sink
+		var err error
+
+		switch name {
+		case "zmq":
+			sink, err = emdr.NewZMQSink(config.ZMQBindEndpoints, config.ZMQMode, config.ZMQCurveSecretKey, config.ZMQCurveClientKeys, config.ZMQLinger)
+		case "nats":
+			sink, err = emdr.NewNATSSink(config.NATSURL, config.NATSSubjectPrefix, config.NATSStream)
+		case "nsq":
+			sink, err = emdr.NewNSQSink(config.NSQDAddresses, config.NSQTopic, config.NSQPerType)
+		case "websocket":
+			webSocketSink := emdr.NewWebSocketSink()
+			mux.Handle("/ws", webSocketSink)
+			sink = webSocketSink
+		case "events":
+			eventSink := emdr.NewEventSink()
+			mux.Handle("/events", eventSink)
+			sink = eventSink
+		default:
+			logrus.Fatalf("Unknown sink: %s", name)
+		}
+
+		if err != nil {
+			logrus.WithError(err).WithField("sink", name).Fatal("Could not initialize sink!")
+		}
+
+		sinks = append(sinks, sink)
+	}
+
+	return sinks
+}
+
+// Serve HTTP endpoints, crash if the server fails
+func serveHTTP(server *http.Server) {
+	logrus.WithField("endpoint", config.HTTPBindEndpoint).Info("Serving HTTP.")
+
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		logrus.WithError(err).Fatal("HTTP server failed!")
+	}
+}